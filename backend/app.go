@@ -1,19 +1,29 @@
 package backend
 
 import (
+	"io"
+	"mime"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 
-	"github.com/fxkr/openview/backend/cache"
 	"github.com/fxkr/openview/backend/model"
 	"github.com/fxkr/openview/backend/util/handler"
 	"github.com/fxkr/openview/backend/util/safe"
 )
 
+// deepZoomTilePattern matches the path of a Deep Zoom tile relative to /dzi/, as viewers construct it from the descriptor's.
+var deepZoomTilePattern = regexp.MustCompile(`^(.*)_files/(\d+)/(\d+)_(\d+)\.jpg$`)
+
 type Application struct {
 	config  *Config
 	router  chi.Router
@@ -24,34 +34,59 @@ func NewApplication(config *Config) (*Application, error) {
 	Initialize()
 	defer Terminate()
 
-	c, err := cache.NewFileCache(config.CacheDir)
+	if config.ThumbSizes == nil {
+		config.ThumbSizes = model.DefaultThumbSizes
+	}
+	switch config.ImageVersioning {
+	case "", VersionModTime, VersionContentHash:
+	default:
+		return nil, errors.Errorf("Bad image versioning: %v", config.ImageVersioning)
+	}
+	err := config.Thumbnail.Watermark.Validate()
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	mc, err := cache.NewMiniRedisCache(cache.MiniRedisCacheConfig{})
+	c, err := newThumbnailCache(config)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
+	mc, err := newMetadataCache(config)
+	if err != nil {
+		c.Close()
+		return nil, errors.WithStack(err)
+	}
+
 	app := &Application{
 		config:  config,
 		router:  chi.NewRouter(),
-		service: NewService(config.ImageDir, config.ResourceDir, c, mc),
+		service: NewService(config, c, mc),
 	}
 
 	r := app.router
+	r.Use(handler.Compress)
+	get := func(pattern string, h http.HandlerFunc) {
+		// HEAD requests are served by the same handlers, the server discards their bodies.
+		r.Get(pattern, h)
+		r.Head(pattern, h)
+	}
 	for _, file := range []string{"favicon.ico"} {
-		r.Get("/"+file, app.handleResourceFile)
+		get("/"+file, cacheControl(config.CacheControl.Resources, app.handleResourceFile))
 	}
-	r.Get("/static/*", app.handleResource)
-	r.Get("/*", app.handlePath)
+	get("/static/*", cacheControl(config.CacheControl.Resources, app.handleResource))
+	get("/dzi/*", cacheControl(config.CacheControl.Renditions, app.handleDeepZoom))
+	get("/*", app.handlePath)
 	r.NotFound(handler.Status(http.StatusNotFound).ServeHTTP)
 
 	return app, nil
 }
 
 func (app *Application) Run() error {
+	if app.config.GCInterval > 0 {
+		go app.runGarbageCollector()
+	}
+
 	err := http.ListenAndServe(app.config.ListenAddress, app.router)
 	if err != nil {
 		return errors.WithStack(err)
@@ -60,6 +95,57 @@ func (app *Application) Run() error {
 	return nil
 }
 
+// CollectGarbage deletes orphaned and outdated cache entries. See Service.CollectGarbage.
+func (app *Application) CollectGarbage(dryRun bool, fn func(GCEntry)) (*GCReport, error) {
+	return app.service.CollectGarbage(dryRun, fn)
+}
+
+// ExportCache writes the current cache entries to w. See Service.ExportCache.
+func (app *Application) ExportCache(w io.Writer) (*ArchiveReport, error) {
+	return app.service.ExportCache(w, app.archiveExclude())
+}
+
+// ImportCache reads cache entries exported on another host from r. See Service.ImportCache.
+func (app *Application) ImportCache(r io.Reader) (*ArchiveReport, error) {
+	return app.service.ImportCache(r, app.archiveExclude())
+}
+
+// archiveExclude returns the caches left out of cache exports and imports.
+//
+// A memory metadata cache is empty when an export starts and lost when an import ends, so it's left out.
+func (app *Application) archiveExclude() []string {
+	if app.config.MetadataCache == "" || app.config.MetadataCache == CacheMemory {
+		return []string{"metadata"}
+	}
+	return nil
+}
+
+func (app *Application) runGarbageCollector() {
+	for range time.Tick(app.config.GCInterval) {
+		report, err := app.CollectGarbage(false, nil)
+		if err != nil {
+			log.WithError(err).Error("Cache garbage collection failed")
+			continue
+		}
+		log.WithFields(log.Fields{
+			"entries": report.Entries,
+			"deleted": report.Garbage,
+			"size":    report.Size,
+		}).Info("Collected cache garbage")
+	}
+}
+
+// cacheControl wraps h to send the Cache-Control header policy, unless it's empty. Errors remove it again.
+func cacheControl(policy string, h http.HandlerFunc) http.HandlerFunc {
+	if policy == "" {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", policy)
+		h(w, r)
+	}
+}
+
 func (app *Application) handleResourceFile(w http.ResponseWriter, r *http.Request) {
 	unescapedPathStr, err := url.QueryUnescape(r.URL.Path)
 	if err != nil {
@@ -72,8 +158,7 @@ func (app *Application) handleResourceFile(w http.ResponseWriter, r *http.Reques
 		handler.StatusError(http.StatusBadRequest, errors.WithStack(err)).ServeHTTP(w, r)
 		return
 	}
-	fullPath := app.config.ResourceDir.Join(relativePath)
-	http.ServeFile(w, r, fullPath.String())
+	serveResource(w, r, app.config.ResourceDir.Join(relativePath))
 }
 
 func (app *Application) handleResource(w http.ResponseWriter, r *http.Request) {
@@ -88,8 +173,49 @@ func (app *Application) handleResource(w http.ResponseWriter, r *http.Request) {
 		handler.StatusError(http.StatusBadRequest, errors.WithStack(err)).ServeHTTP(w, r)
 		return
 	}
-	fullPath := app.config.ResourceDir.Join(relativePath)
-	http.ServeFile(w, r, fullPath.String())
+	serveResource(w, r, app.config.ResourceDir.Join(relativePath))
+}
+
+// precompressedResources maps encodings to the extensions of precompressed siblings of resources.
+var precompressedResources = map[string]string{"br": ".br", "gzip": ".gz"}
+
+// serveResource serves a frontend resource, or a precompressed sibling (e.g. app.js.br) if the client accepts it.
+//
+// Vary is set by handler.Compress, which leaves responses that are already encoded alone.
+func serveResource(w http.ResponseWriter, r *http.Request, fullPath safe.Path) {
+	encodings := []string{}
+	for _, encoding := range handler.Encodings {
+		_, err := os.Stat(fullPath.String() + precompressedResources[encoding])
+		if err == nil {
+			encodings = append(encodings, encoding)
+		}
+	}
+
+	encoding := handler.AcceptedEncoding(r, encodings...)
+	if encoding == "" {
+		http.ServeFile(w, r, fullPath.String())
+		return
+	}
+
+	f, err := os.Open(fullPath.String() + precompressedResources[encoding])
+	if err != nil {
+		handler.Error(errors.WithStack(err)).ServeHTTP(w, r)
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		handler.Error(errors.WithStack(err)).ServeHTTP(w, r)
+		return
+	}
+
+	// The type is that of the resource, not of the compressed file.
+	if contentType := mime.TypeByExtension(filepath.Ext(fullPath.String())); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Content-Encoding", encoding)
+	http.ServeContent(w, r, "", stat.ModTime(), f)
 }
 
 func (app *Application) handlePath(w http.ResponseWriter, r *http.Request) {
@@ -100,15 +226,20 @@ func (app *Application) handlePath(w http.ResponseWriter, r *http.Request) {
 		action = "thumb"
 	}
 
+	policies := app.config.CacheControl
 	switch action {
 	case "":
-		app.handleFile(w, r)
+		cacheControl(policies.Files, app.handleFile)(w, r)
 	case "thumb":
-		app.handleThumbnail(w, r)
+		cacheControl(policies.Renditions, app.handleThumbnail)(w, r)
 	case "info":
-		app.handleDirectoryInfo(w, r)
+		cacheControl(policies.Info, app.handleDirectoryInfo)(w, r)
 	case "image-info":
-		app.handleImageInfo(w, r)
+		cacheControl(policies.Info, app.handleImageInfo)(w, r)
+	case "protected":
+		cacheControl(policies.Renditions, app.handleProtected)(w, r)
+	case "contact-sheet":
+		cacheControl(policies.Renditions, app.handleContactSheet)(w, r)
 	default:
 		handler.Status(http.StatusBadRequest).ServeHTTP(w, r)
 	}
@@ -181,11 +312,96 @@ func (app *Application) handleThumbnail(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	size, err := model.NewThumbSize(r.URL.Query().Get("size"))
+	size, err := app.config.ThumbSizes.Get(r.URL.Query().Get("size"))
+	if err != nil {
+		handler.StatusError(http.StatusBadRequest, errors.WithStack(err)).ServeHTTP(w, r)
+		return
+	}
+
+	_, poster := r.URL.Query()["poster"]
+
+	app.service.GetImageThumbnail(path, size, poster).ServeHTTP(w, r)
+}
+
+func (app *Application) handleProtected(w http.ResponseWriter, r *http.Request) {
+	unescapedPathStr, err := url.QueryUnescape(chi.URLParam(r, "*"))
+	if err != nil {
+		handler.StatusError(http.StatusBadRequest, errors.WithStack(err)).ServeHTTP(w, r)
+		return
+	}
+
+	path, err := safe.NewRelativePath(strings.Trim(unescapedPathStr, "/"))
+	if err != nil {
+		handler.StatusError(http.StatusBadRequest, errors.WithStack(err)).ServeHTTP(w, r)
+		return
+	}
+
+	app.service.GetImageProtected(path).ServeHTTP(w, r)
+}
+
+func (app *Application) handleContactSheet(w http.ResponseWriter, r *http.Request) {
+	layout, err := model.NewContactSheet(r.URL.Query().Get("columns"), r.URL.Query().Get("tile_size"))
+	if err != nil {
+		handler.StatusError(http.StatusBadRequest, errors.WithStack(err)).ServeHTTP(w, r)
+		return
+	}
+
+	unescapedPathStr, err := url.QueryUnescape(chi.URLParam(r, "*"))
+	if err != nil {
+		handler.StatusError(http.StatusBadRequest, errors.WithStack(err)).ServeHTTP(w, r)
+		return
+	}
+
+	path, err := safe.NewRelativePath(strings.Trim(unescapedPathStr, "/"))
+	if err != nil {
+		handler.StatusError(http.StatusBadRequest, errors.WithStack(err)).ServeHTTP(w, r)
+		return
+	}
+
+	app.service.GetContactSheet(path, layout).ServeHTTP(w, r)
+}
+
+// handleDeepZoom serves Deep Zoom descriptors (/dzi/<path>.dzi) and tiles (/dzi/<path>_files/<level>/<col>_<row>.jpg).
+func (app *Application) handleDeepZoom(w http.ResponseWriter, r *http.Request) {
+	unescapedPathStr, err := url.QueryUnescape(chi.URLParam(r, "*"))
 	if err != nil {
 		handler.StatusError(http.StatusBadRequest, errors.WithStack(err)).ServeHTTP(w, r)
 		return
 	}
+	unescapedPathStr = strings.Trim(unescapedPathStr, "/")
+
+	if strings.HasSuffix(unescapedPathStr, ".dzi") {
+		path, err := safe.NewRelativePath(strings.TrimSuffix(unescapedPathStr, ".dzi"))
+		if err != nil {
+			handler.StatusError(http.StatusBadRequest, errors.WithStack(err)).ServeHTTP(w, r)
+			return
+		}
+
+		app.service.GetDeepZoomDescriptor(path).ServeHTTP(w, r)
+		return
+	}
+
+	match := deepZoomTilePattern.FindStringSubmatch(unescapedPathStr)
+	if match == nil {
+		handler.Status(http.StatusNotFound).ServeHTTP(w, r)
+		return
+	}
+
+	path, err := safe.NewRelativePath(match[1])
+	if err != nil {
+		handler.StatusError(http.StatusBadRequest, errors.WithStack(err)).ServeHTTP(w, r)
+		return
+	}
+
+	var coordinates [3]uint
+	for i := range coordinates {
+		value, err := strconv.ParseUint(match[i+2], 10, 16)
+		if err != nil {
+			handler.StatusError(http.StatusBadRequest, errors.WithStack(err)).ServeHTTP(w, r)
+			return
+		}
+		coordinates[i] = uint(value)
+	}
 
-	app.service.GetImageThumbnail(path, size).ServeHTTP(w, r)
+	app.service.GetDeepZoomTile(path, coordinates[0], coordinates[1], coordinates[2]).ServeHTTP(w, r)
 }
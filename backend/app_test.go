@@ -1,10 +1,13 @@
 package backend
 
 import (
+	"bytes"
+	"compress/gzip"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/pkg/errors"
@@ -80,3 +83,130 @@ func (s *AppSuite) TestFavicon(c *C) {
 	c.Assert(rr.Code, Equals, http.StatusOK)
 	c.Assert(rr.Body.Bytes(), DeepEquals, expectedBytes)
 }
+
+func (s *AppSuite) TestHead(c *C) {
+	err := ioutil.WriteFile(s.imageDir.JoinUnsafe("a.txt").String(), []byte("hello"), 0600)
+	c.Assert(err, IsNil)
+
+	req, err := http.NewRequest("HEAD", "/a.txt", nil)
+	c.Assert(err, IsNil)
+	rr := httptest.NewRecorder()
+	s.app.router.ServeHTTP(rr, req)
+
+	c.Assert(rr.Code, Equals, http.StatusOK)
+	c.Assert(rr.Header().Get("Content-Length"), Equals, "5")
+	c.Assert(rr.Body.Len(), Equals, 0)
+}
+
+func (s *AppSuite) TestCompress(c *C) {
+	text := strings.Repeat("hello ", 100)
+	err := ioutil.WriteFile(s.imageDir.JoinUnsafe("a.txt").String(), []byte(text), 0600)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(s.imageDir.JoinUnsafe("a.jpg").String(), []byte(text), 0600)
+	c.Assert(err, IsNil)
+
+	req, err := http.NewRequest("GET", "/a.txt", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	rr := httptest.NewRecorder()
+	s.app.router.ServeHTTP(rr, req)
+
+	c.Assert(rr.Code, Equals, http.StatusOK)
+	c.Assert(rr.Header().Get("Content-Encoding"), Equals, "gzip")
+	gz, err := gzip.NewReader(rr.Body)
+	c.Assert(err, IsNil)
+	body, err := ioutil.ReadAll(gz)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, text)
+	etag := rr.Header().Get("ETag")
+	c.Assert(strings.HasPrefix(etag, "W/"), Equals, true)
+
+	// Same headers, without the body
+	req, err = http.NewRequest("HEAD", "/a.txt", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	rr = httptest.NewRecorder()
+	s.app.router.ServeHTTP(rr, req)
+
+	c.Assert(rr.Code, Equals, http.StatusOK)
+	c.Assert(rr.Header().Get("Content-Encoding"), Equals, "gzip")
+	c.Assert(rr.Header().Get("Content-Length"), Equals, "")
+	c.Assert(rr.Header().Get("ETag"), Equals, etag)
+	c.Assert(rr.Body.Len(), Equals, 0)
+
+	// Revalidating the compressed copy
+	req, err = http.NewRequest("GET", "/a.txt", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	s.app.router.ServeHTTP(rr, req)
+
+	c.Assert(rr.Code, Equals, http.StatusNotModified)
+	c.Assert(rr.Header().Get("ETag"), Equals, etag)
+
+	// Images are compressed already.
+	req, err = http.NewRequest("GET", "/a.jpg", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr = httptest.NewRecorder()
+	s.app.router.ServeHTTP(rr, req)
+
+	c.Assert(rr.Code, Equals, http.StatusOK)
+	c.Assert(rr.Header().Get("Content-Encoding"), Equals, "")
+	c.Assert(rr.Body.String(), Equals, text)
+}
+
+func (s *AppSuite) TestPrecompressedResource(c *C) {
+	path := s.tempDir.JoinUnsafe("app.js")
+	c.Assert(ioutil.WriteFile(path.String(), []byte("plain"), 0600), IsNil)
+	c.Assert(ioutil.WriteFile(path.String()+".br", []byte("brotli"), 0600), IsNil)
+
+	for encodings, expected := range map[string]string{"gzip, br": "brotli", "gzip": "plain"} {
+		req, err := http.NewRequest("GET", "/static/app.js", nil)
+		c.Assert(err, IsNil)
+		req.Header.Set("Accept-Encoding", encodings)
+		rr := httptest.NewRecorder()
+		serveResource(rr, req, path)
+
+		c.Assert(rr.Code, Equals, http.StatusOK)
+		c.Assert(rr.Body.String(), Equals, expected)
+		c.Assert(rr.Header().Get("Content-Type"), Not(Equals), "")
+	}
+}
+
+func (s *AppSuite) TestHiddenFiles(c *C) {
+	c.Assert(os.Mkdir(s.imageDir.JoinUnsafe(".hidden").String(), 0700), IsNil)
+	for _, name := range []string{SettingsFileName, ".watermark.png", ".hidden/a.txt"} {
+		err := ioutil.WriteFile(s.imageDir.JoinUnsafe(name).String(), []byte("secret"), 0600)
+		c.Assert(err, IsNil)
+
+		req, err := http.NewRequest("GET", "/"+name, nil)
+		c.Assert(err, IsNil)
+		rr := httptest.NewRecorder()
+		s.app.router.ServeHTTP(rr, req)
+
+		c.Assert(rr.Code, Equals, http.StatusNotFound, Commentf("%s", name))
+	}
+
+	// Hidden directories can't be listed either.
+	for _, target := range []string{"/.hidden?action=info", "/.hidden?action=contact-sheet"} {
+		req, err := http.NewRequest("GET", target, nil)
+		c.Assert(err, IsNil)
+		rr := httptest.NewRecorder()
+		s.app.router.ServeHTTP(rr, req)
+
+		c.Assert(rr.Code, Equals, http.StatusNotFound, Commentf("%s", target))
+	}
+}
+
+func (s *AppSuite) TestCacheArchiveMemoryMetadata(c *C) {
+	var archive bytes.Buffer
+	report, err := s.app.ExportCache(&archive)
+	c.Assert(err, IsNil)
+	c.Assert(report.Excluded, DeepEquals, []string{"metadata"})
+
+	report, err = s.app.ImportCache(&archive)
+	c.Assert(err, IsNil)
+	c.Assert(report.Excluded, DeepEquals, []string{"metadata"})
+}
@@ -0,0 +1,248 @@
+package backend
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/fxkr/openview/backend/cache"
+)
+
+// cacheArchiveMagic starts every cache archive, so other files are rejected early.
+//
+// It's followed by the entries, each a JSON encoded archiveHeader on its own line and then the value.
+// The whole archive is gzip compressed.
+const cacheArchiveMagic = "openview-cache-archive 1\n"
+
+// ArchiveReport summarizes a cache export or import.
+type ArchiveReport struct {
+	Entries  int      // Number of entries exported or imported
+	Skipped  int      // Number of orphaned, outdated or expired entries, and entries of excluded caches
+	Size     int64    // Total size of exported or imported values
+	Excluded []string // Names of the caches that were left out
+}
+
+type archiveHeader struct {
+	Cache   string `json:"cache"`
+	Key     string `json:"key"`
+	Version string `json:"version"`
+	Size    int64  `json:"size"`
+	Expires int64  `json:"expires,omitempty"` // Unix time in nanoseconds
+}
+
+// errMissing is returned by the filler of archive exports, so nothing is rendered.
+var errMissing = errors.New("Cache entry is missing")
+
+// ExportCache writes the current entries of the thumbnail and metadata caches to w, except those of the caches
+// named in exclude.
+//
+// Orphaned and outdated entries are skipped, like the garbage collector would delete them.
+func (s *service) ExportCache(w io.Writer, exclude []string) (*ArchiveReport, error) {
+	report := &ArchiveReport{Excluded: exclude}
+
+	gz := gzip.NewWriter(w)
+	_, err := io.WriteString(gz, cacheArchiveMagic)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	enc := json.NewEncoder(gz)
+	for _, c := range s.caches() {
+		if contains(exclude, c.name) {
+			continue
+		}
+		err := c.cache.Walk("", func(entry cache.Entry) error {
+			reason, err := s.checkCacheEntry(entry)
+			if err != nil {
+				log.WithError(err).WithField("key", entry.Key.String()).Warn("Failed to check cache entry")
+				report.Skipped++
+				return nil
+			} else if reason != "" {
+				report.Skipped++
+				return nil
+			}
+
+			r, err := c.cache.GetStream(entry.Key, cache.Raw(entry.Version), func(w io.Writer) (cache.Version, error) {
+				return nil, errMissing
+			})
+			if errors.Cause(err) == errMissing {
+				report.Skipped++ // Deleted or expired since the walk
+				return nil
+			} else if err != nil {
+				return errors.WithStack(err)
+			}
+			defer r.Close()
+
+			header := archiveHeader{c.name, entry.Key.String(), entry.Version, entry.Size, 0}
+			if !entry.Expires.IsZero() {
+				header.Expires = entry.Expires.UnixNano()
+			}
+			err = enc.Encode(&header) // Adds the newline
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			// The value has the walked version, so it has the walked size, unless it was rendered again differently.
+			_, err = io.Copy(gz, &sizedReader{r, header.Size})
+			if err != nil {
+				return errors.Wrapf(err, "Failed to export cache entry: %v", header.Key)
+			}
+			if n, _ := r.Read(make([]byte, 1)); n > 0 {
+				return errors.Errorf("Cache entry changed during export: %v", header.Key)
+			}
+
+			report.Entries++
+			report.Size += header.Size
+			return nil
+		})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	err = gz.Close()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return report, nil
+}
+
+// ImportCache reads an archive written by ExportCache and puts its entries into the caches,
+// except those of the caches named in exclude.
+//
+// Entries are only imported if their version matches the one computed from the local ImageDir,
+// so archives from a host with different images or settings can't cause stale thumbnails.
+// Watermark images are versioned by modification time, so renditions with a watermark image are only imported
+// if it has the same modification time on both hosts.
+func (s *service) ImportCache(r io.Reader, exclude []string) (*ArchiveReport, error) {
+	report := &ArchiveReport{Excluded: exclude}
+
+	caches := map[string]cache.Cache{}
+	for _, c := range s.caches() {
+		caches[c.name] = c.cache
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "Not a cache archive")
+	}
+	defer gz.Close()
+	br := bufio.NewReader(gz)
+
+	magic := make([]byte, len(cacheArchiveMagic))
+	_, err = io.ReadFull(br, magic)
+	if err != nil || string(magic) != cacheArchiveMagic {
+		return nil, errors.New("Not a cache archive")
+	}
+
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		} else if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		var header archiveHeader
+		err = json.Unmarshal(line, &header)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid cache archive entry")
+		}
+		c, ok := caches[header.Cache]
+		if !ok || header.Size < 0 {
+			return nil, errors.Errorf("Invalid cache archive entry: %v", header.Key)
+		}
+
+		value := &sizedReader{br, header.Size}
+
+		if contains(exclude, header.Cache) {
+			err = skip(value)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			report.Skipped++
+			continue
+		}
+
+		var ttl time.Duration
+		if header.Expires != 0 {
+			ttl = time.Until(time.Unix(0, header.Expires))
+			if ttl <= 0 {
+				err = skip(value)
+				if err != nil {
+					return nil, errors.WithStack(err)
+				}
+				report.Skipped++
+				continue
+			}
+		}
+
+		version, err := s.getCurrentVersion(header.Key)
+		if err != nil && err != errOrphaned {
+			log.WithError(err).WithField("key", header.Key).Warn("Failed to check cache entry")
+		}
+		if err != nil || version.String() != header.Version {
+			err = skip(value)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			report.Skipped++
+			continue
+		}
+
+		err = c.PutStream(cache.Raw(header.Key), version, value, ttl)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		report.Entries++
+		report.Size += header.Size
+	}
+
+	return report, nil
+}
+
+// sizedReader reads the n bytes of a value from r, and fails with io.ErrUnexpectedEOF if r ends before.
+type sizedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *sizedReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.r.Read(p)
+	r.n -= int64(n)
+	if err == io.EOF && r.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// skip reads the rest of a value that isn't imported.
+func skip(value *sizedReader) error {
+	_, err := io.Copy(ioutil.Discard, value)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// contains returns true if name is one of names.
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package backend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+
+	"github.com/fxkr/openview/backend/cache"
+	"github.com/fxkr/openview/backend/model"
+	"github.com/fxkr/openview/backend/util/safe"
+)
+
+func TestArchive(t *testing.T) {
+	_ = Suite(&ArchiveSuite{})
+	TestingT(t)
+}
+
+type ArchiveSuite struct {
+	tempDir safe.Path
+}
+
+func (s *ArchiveSuite) SetUpTest(c *C) {
+	tempDir, err := ioutil.TempDir("", "openview-test")
+	if err != nil {
+		c.Fatalf("Error: %+v", errors.WithStack(err))
+	}
+	s.tempDir = safe.UnsafeNewPath(tempDir)
+
+	err = ioutil.WriteFile(s.tempDir.JoinUnsafe("a.jpg").String(), []byte("jpeg"), 0600)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(s.tempDir.JoinUnsafe("b.jpg").String(), []byte("jpeg"), 0600)
+	c.Assert(err, IsNil)
+}
+
+func (s *ArchiveSuite) TearDownTest(c *C) {
+	os.RemoveAll(s.tempDir.String())
+}
+
+func (s *ArchiveSuite) newService() *service {
+	return NewService(&Config{
+		ImageDir:   s.tempDir,
+		ThumbSizes: model.DefaultThumbSizes,
+	}, cache.NewMemoryCache(cache.MemoryCacheConfig{}), cache.NewMemoryCache(cache.MemoryCacheConfig{})).(*service)
+}
+
+func (s *ArchiveSuite) TestExportImport(c *C) {
+	source := s.newService()
+	for _, name := range []string{"a.jpg", "b.jpg"} {
+		path := safe.UnsafeNewRelativePath(name)
+		fileInfo, err := os.Stat(s.tempDir.Join(path).String())
+		c.Assert(err, IsNil)
+		c.Assert(source.metadataCache.Put(safe.NewKey("imagemeta", name), source.getImageVersion(path, fileInfo), []byte(name)), IsNil)
+	}
+	c.Assert(source.metadataCache.Put(safe.NewKey("imagemeta", "deleted.jpg"), safe.NewKey("old"), []byte("x")), IsNil)
+
+	var archive bytes.Buffer
+	report, err := source.ExportCache(&archive, nil)
+	c.Assert(err, IsNil)
+	c.Assert(*report, DeepEquals, ArchiveReport{Entries: 2, Skipped: 1, Size: 10})
+
+	// b.jpg changed on the importing host.
+	err = ioutil.WriteFile(s.tempDir.JoinUnsafe("b.jpg").String(), []byte("changed"), 0600)
+	c.Assert(err, IsNil)
+
+	target := s.newService()
+	report, err = target.ImportCache(&archive, nil)
+	c.Assert(err, IsNil)
+	c.Assert(*report, DeepEquals, ArchiveReport{Entries: 1, Skipped: 1, Size: 5})
+
+	var keys []string
+	err = target.metadataCache.Walk("", func(entry cache.Entry) error {
+		keys = append(keys, entry.Key.String())
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []string{safe.NewKey("imagemeta", "a.jpg").String()})
+}
+
+func (s *ArchiveSuite) TestImportInvalid(c *C) {
+	_, err := s.newService().ImportCache(bytes.NewBufferString("not an archive"), nil)
+	c.Assert(err, NotNil)
+}
+
+func (s *ArchiveSuite) TestExclude(c *C) {
+	source := s.newService()
+	path := safe.UnsafeNewRelativePath("a.jpg")
+	fileInfo, err := os.Stat(s.tempDir.Join(path).String())
+	c.Assert(err, IsNil)
+	c.Assert(source.metadataCache.Put(safe.NewKey("imagemeta", "a.jpg"), source.getImageVersion(path, fileInfo), []byte("a.jpg")), IsNil)
+
+	var archive bytes.Buffer
+	report, err := source.ExportCache(&archive, []string{"metadata"})
+	c.Assert(err, IsNil)
+	c.Assert(*report, DeepEquals, ArchiveReport{Excluded: []string{"metadata"}})
+
+	archive.Reset()
+	_, err = source.ExportCache(&archive, nil)
+	c.Assert(err, IsNil)
+
+	target := s.newService()
+	report, err = target.ImportCache(&archive, []string{"metadata"})
+	c.Assert(err, IsNil)
+	c.Assert(*report, DeepEquals, ArchiveReport{Skipped: 1, Excluded: []string{"metadata"}})
+
+	_, err = target.metadataCache.GetBytes(safe.NewKey("imagemeta", "a.jpg"), source.getImageVersion(path, fileInfo), func() (cache.Version, []byte, error) {
+		return nil, nil, errors.New("Not imported")
+	})
+	c.Assert(err, NotNil)
+}
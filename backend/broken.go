@@ -0,0 +1,93 @@
+package backend
+
+import (
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/fxkr/openview/backend/cache"
+	"github.com/fxkr/openview/backend/image"
+	"github.com/fxkr/openview/backend/util/handler"
+	"github.com/fxkr/openview/backend/util/safe"
+)
+
+// placeholderSVG is served instead of thumbnails of broken images, unless Config.PlaceholderImage is set.
+const placeholderSVG = `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 100 100">` +
+	`<rect width="100" height="100" fill="#ddd"/>` +
+	`<path d="M35 35L65 65M65 35L35 65" stroke="#999" stroke-width="6" stroke-linecap="round"/>` +
+	`</svg>`
+
+// brokenImageError is the cause of errors about images that can't be decoded.
+type brokenImageError struct {
+	message string
+}
+
+func (e *brokenImageError) Error() string {
+	return "Broken image: " + e.message
+}
+
+// isBroken returns true if err is about an image that can't be decoded.
+func isBroken(err error) bool {
+	_, ok := errors.Cause(err).(*brokenImageError)
+	return ok
+}
+
+// errNotFailed is returned by the filler of failure lookups, so nothing is cached.
+var errNotFailed = errors.New("Image did not fail to decode")
+
+// decode runs fn, which decodes an image, unless that already failed for the current version of the image.
+//
+// Failures to decode the image itself, i.e. errors caused by an image.DecodeError, are cached in the metadata cache
+// for Config.FailureTTL, so broken images aren't decoded again and again. Other errors are returned as they are.
+func (s *service) decode(path safe.RelativePath, fileInfo os.FileInfo, fn func() error) error {
+	cacheKey := safe.NewKey("failed", path.String())
+	cacheVersion := s.getImageVersion(path, fileInfo)
+
+	if message, ok := s.getFailure(path, cacheVersion); ok {
+		return errors.WithStack(handler.StatusError(http.StatusUnprocessableEntity, &brokenImageError{message}))
+	}
+
+	err := fn()
+	if err == nil {
+		return nil
+	} else if _, ok := errors.Cause(err).(*image.DecodeError); !ok {
+		return errors.WithStack(err)
+	}
+
+	log.WithError(err).WithField("path", path.String()).Warn("Failed to decode image")
+
+	// Only the first line, without the stack trace.
+	message := []byte(strings.SplitN(err.Error(), "\n", 2)[0])
+	putErr := s.metadataCache.PutTTL(cacheKey, cacheVersion, message, s.config.FailureTTL)
+	if putErr != nil {
+		log.WithError(putErr).WithField("path", path.String()).Warn("Failed to cache decoding failure")
+	}
+
+	return errors.WithStack(handler.StatusError(http.StatusUnprocessableEntity, &brokenImageError{string(message)}))
+}
+
+// getFailure returns the cached message of a failure to decode an image, if decoding the version of the image failed.
+func (s *service) getFailure(path safe.RelativePath, version cache.Version) (string, bool) {
+	message, err := s.metadataCache.GetBytes(safe.NewKey("failed", path.String()), version, func() (cache.Version, []byte, error) {
+		return nil, nil, errNotFailed
+	})
+	if err != nil {
+		return "", false
+	}
+	return string(message), true
+}
+
+// placeholder returns a handler serving the placeholder thumbnail of broken images.
+func (s *service) placeholder() http.Handler {
+	if !s.config.PlaceholderImage.IsEmpty() {
+		return &handler.FileHandler{Path: s.config.PlaceholderImage}
+	}
+	return &handler.ReaderHandler{
+		Reader:      strings.NewReader(placeholderSVG),
+		ContentType: "image/svg+xml",
+		Validators:  handler.Validators{ETag: handler.ETag(placeholderSVG)},
+	}
+}
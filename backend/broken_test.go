@@ -0,0 +1,137 @@
+package backend
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+
+	"github.com/fxkr/openview/backend/cache"
+	"github.com/fxkr/openview/backend/image"
+	"github.com/fxkr/openview/backend/model"
+	"github.com/fxkr/openview/backend/util/safe"
+)
+
+func TestBroken(t *testing.T) {
+	_ = Suite(&BrokenSuite{})
+	TestingT(t)
+}
+
+type BrokenSuite struct {
+	tempDir safe.Path
+	service *service
+}
+
+func (s *BrokenSuite) SetUpTest(c *C) {
+	tempDir, err := ioutil.TempDir("", "openview-test")
+	if err != nil {
+		c.Fatalf("Error: %+v", errors.WithStack(err))
+	}
+	s.tempDir = safe.UnsafeNewPath(tempDir)
+
+	s.service = NewService(&Config{
+		ImageDir: s.tempDir,
+	}, cache.NewMemoryCache(cache.MemoryCacheConfig{}), cache.NewMemoryCache(cache.MemoryCacheConfig{})).(*service)
+}
+
+func (s *BrokenSuite) TearDownTest(c *C) {
+	os.RemoveAll(s.tempDir.String())
+}
+
+func (s *BrokenSuite) write(c *C, content string) (safe.RelativePath, os.FileInfo) {
+	fullPath := s.tempDir.JoinUnsafe("a.jpg").String()
+	c.Assert(ioutil.WriteFile(fullPath, []byte(content), 0600), IsNil)
+
+	// A different modification time makes a different version.
+	modTime := time.Now().Add(-time.Duration(len(content)) * time.Hour)
+	c.Assert(os.Chtimes(fullPath, modTime, modTime), IsNil)
+
+	fileInfo, err := os.Stat(fullPath)
+	c.Assert(err, IsNil)
+	return safe.UnsafeNewRelativePath("a.jpg"), fileInfo
+}
+
+func (s *BrokenSuite) TestDecode(c *C) {
+	calls := 0
+	fail := func() error {
+		calls++
+		return errors.WithStack(&image.DecodeError{Message: "Truncated file"})
+	}
+
+	path, fileInfo := s.write(c, "jp")
+	for i := 0; i < 2; i++ {
+		err := s.service.decode(path, fileInfo, fail)
+		c.Assert(isBroken(err), Equals, true)
+		c.Assert(errors.Cause(err).Error(), Equals, "Broken image: Truncated file")
+	}
+	c.Assert(calls, Equals, 1)
+
+	// Fixed
+	path, fileInfo = s.write(c, "jpeg")
+	c.Assert(s.service.decode(path, fileInfo, func() error { return nil }), IsNil)
+}
+
+func (s *BrokenSuite) TestDecodeTransient(c *C) {
+	calls := 0
+	fail := func() error {
+		calls++
+		return errors.New("Resource limit exceeded")
+	}
+
+	path, fileInfo := s.write(c, "jpeg")
+	for i := 0; i < 2; i++ {
+		err := s.service.decode(path, fileInfo, fail)
+		c.Assert(isBroken(err), Equals, false)
+		c.Assert(errors.Cause(err).Error(), Equals, "Resource limit exceeded")
+	}
+	c.Assert(calls, Equals, 2)
+}
+
+func (s *BrokenSuite) TestBrokenAnimation(c *C) {
+	fullPath := s.tempDir.JoinUnsafe("a.gif").String()
+	c.Assert(ioutil.WriteFile(fullPath, []byte("GIF89a"), 0600), IsNil)
+	fileInfo, err := os.Stat(fullPath)
+	c.Assert(err, IsNil)
+
+	path := safe.UnsafeNewRelativePath("a.gif")
+	err = s.service.metadataCache.Put(safe.NewKey("failed", path.String()), s.service.getImageVersion(path, fileInfo), []byte("Truncated file"))
+	c.Assert(err, IsNil)
+
+	w := httptest.NewRecorder()
+	s.service.GetImageThumbnail(path, model.DefaultThumbSizes.AtLeast(240), false).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, placeholderSVG)
+}
+
+func (s *BrokenSuite) TestFailedAfterMetadata(c *C) {
+	path, fileInfo := s.write(c, "jpeg")
+	version := s.service.getImageVersion(path, fileInfo)
+	err := s.service.metadataCache.Put(safe.NewKey("imagemeta", path.String()), version, []byte(`{"width": 100, "height": 50}`))
+	c.Assert(err, IsNil)
+
+	images := s.service.getImagesData([]safe.RelativePath{path})
+	c.Assert(images[0].Error, Equals, false)
+	c.Assert(images[0].Width, Equals, uint(100))
+
+	// The metadata was cached, but the thumbnail can't be decoded.
+	err = s.service.decode(path, fileInfo, func() error {
+		return errors.WithStack(&image.DecodeError{Message: "Truncated file"})
+	})
+	c.Assert(isBroken(err), Equals, true)
+
+	images = s.service.getImagesData([]safe.RelativePath{path})
+	c.Assert(images[0].Error, Equals, true)
+	c.Assert(images[0].Width, Equals, uint(100))
+}
+
+func (s *BrokenSuite) TestPlaceholder(c *C) {
+	w := httptest.NewRecorder()
+	s.service.placeholder().ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	c.Assert(w.Header().Get("Content-Type"), Equals, "image/svg+xml")
+	c.Assert(w.Body.String(), Equals, placeholderSVG)
+}
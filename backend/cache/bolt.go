@@ -0,0 +1,518 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/fxkr/openview/backend/util/handler"
+	"github.com/fxkr/openview/backend/util/safe"
+)
+
+// BoltCache is Cache implementation that stores values in an embedded bbolt database file.
+//
+// Every write is a transaction that is synced to disk before it returns, so the database survives crashes.
+// Since bbolt never shrinks its file, a background compactor rewrites it when much of it is unused.
+type BoltCache struct {
+	path   safe.Path
+	config BoltCacheConfig
+
+	// lock is held for reading while db is used and for writing while it's replaced by a compacted copy.
+	lock sync.RWMutex
+	db   *bolt.DB
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type BoltCacheConfig struct {
+
+	// CompactionInterval is how often the database is checked for unused space. Zero disables compaction.
+	CompactionInterval time.Duration `json:"compaction_interval"`
+
+	// Timeout is how long to wait for the database if another process has it open. Zero means one second.
+	Timeout time.Duration `json:"timeout"`
+
+	// ReadOnly opens an existing database without modifying it, e.g. to export it. Writes fail,
+	// and it's never compacted. A database opened for writing by another process still can't be opened.
+	ReadOnly bool `json:"read_only"`
+}
+
+// Statically assert that *BoltCache implements Cache.
+var _ Cache = (*BoltCache)(nil)
+
+// boltBucket is the bucket all entries are stored in.
+var boltBucket = []byte("entries")
+
+// compactionRatio is the fraction of a database file that must be unused for it to be compacted.
+const compactionRatio = 0.5
+
+// compactSuffix is appended to the name of the database to get the name of the compacted copy.
+const compactSuffix = ".compact"
+
+func NewBoltCache(path safe.Path, config BoltCacheConfig) (*BoltCache, error) {
+	if config.Timeout == 0 {
+		config.Timeout = time.Second
+	}
+
+	// Left over if a compaction was interrupted. The database itself is still intact.
+	if !config.ReadOnly {
+		err := os.Remove(path.String() + compactSuffix)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	db, err := openBolt(path.String(), config)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	c := &BoltCache{
+		path:   path,
+		config: config,
+		db:     db,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	if config.CompactionInterval > 0 && !config.ReadOnly {
+		go c.runCompactor()
+	} else {
+		close(c.done)
+	}
+
+	return c, nil
+}
+
+func openBolt(path string, config BoltCacheConfig) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: config.Timeout, ReadOnly: config.ReadOnly})
+	if err == bolt.ErrTimeout {
+		return nil, errors.Errorf("Cache database is in use by another process: %s", path)
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "Failed to open cache database: %s", path)
+	}
+
+	if config.ReadOnly {
+		err = db.View(func(tx *bolt.Tx) error {
+			if tx.Bucket(boltBucket) == nil {
+				return errors.Errorf("Not a cache database: %s", path)
+			}
+			return nil
+		})
+	} else {
+		err = db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(boltBucket)
+			return err
+		})
+	}
+	if err != nil {
+		db.Close()
+		return nil, errors.WithStack(err)
+	}
+
+	return db, nil
+}
+
+// Close stops the compactor and closes the database.
+func (c *BoltCache) Close() {
+	close(c.stop)
+	<-c.done
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.db.Close()
+}
+
+func (c *BoltCache) Put(key Key, version Version, value []byte) error {
+	return c.PutTTL(key, version, value, 0)
+}
+
+func (c *BoltCache) PutTTL(key Key, version Version, value []byte, ttl time.Duration) error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	record := encodeBoltEntry(boltEntry{version.String(), expiry(ttl), value})
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(key.String()), record)
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+func (c *BoltCache) PutStream(key Key, version Version, r io.Reader, ttl time.Duration) error {
+	value, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return c.PutTTL(key, version, value, ttl)
+}
+
+func (c *BoltCache) GetBytes(key Key, version Version, filler func() (Version, []byte, error)) ([]byte, error) {
+	value, ok, err := c.get(key, version)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if ok {
+		return value, nil
+	}
+
+	version, value, err = filler()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	err = c.Put(key, version, value)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return value, nil
+}
+
+func (c *BoltCache) GetHandler(key Key, version Version, filler func() (Version, []byte, error), contentType string) (http.Handler, error) {
+	bytes, err := c.GetBytes(key, version, filler)
+	if err != nil {
+		return nil, err
+	}
+
+	return &handler.ByteHandler{
+		Bytes:       bytes,
+		ContentType: contentType,
+		Validators:  validators(version),
+	}, nil
+}
+
+// GetStream buffers the value, since bbolt values are read in one piece.
+func (c *BoltCache) GetStream(key Key, version Version, filler StreamFiller) (io.ReadCloser, error) {
+	value, err := c.GetBytes(key, version, buffered(filler))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return ioutil.NopCloser(bytes.NewReader(value)), nil
+}
+
+func (c *BoltCache) GetStreamHandler(key Key, version Version, filler StreamFiller, contentType string) (http.Handler, error) {
+	value, err := c.GetBytes(key, version, buffered(filler))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &handler.ReaderHandler{Reader: bytes.NewReader(value), ContentType: contentType, Validators: validators(version)}, nil
+}
+
+// get returns a copy of the value of an entry if it has the requested version and hasn't expired.
+func (c *BoltCache) get(key Key, version Version) ([]byte, bool, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var value []byte
+	err := c.db.View(func(tx *bolt.Tx) error {
+		record := tx.Bucket(boltBucket).Get([]byte(key.String()))
+		if record == nil {
+			return nil
+		}
+		entry, err := decodeBoltEntry(record)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if entry.version != version.String() || expired(entry.expires) {
+			return nil
+		}
+
+		// Values are only valid during the transaction.
+		value = append([]byte{}, entry.value...)
+		return nil
+	})
+	if err != nil {
+		return nil, false, errors.WithStack(err)
+	}
+
+	return value, value != nil, nil
+}
+
+// Walk reads the entries before calling fn, so fn can modify the cache.
+func (c *BoltCache) Walk(prefix string, fn func(Entry) error) error {
+	c.lock.RLock()
+	var entries []Entry
+	err := c.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltBucket).Cursor()
+		for k, v := cursor.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = cursor.Next() {
+			entry, err := decodeBoltEntry(v)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if expired(entry.expires) {
+				continue
+			}
+			entries = append(entries, Entry{Raw(k), entry.version, int64(len(entry.value)), entry.expires})
+		}
+		return nil
+	})
+	c.lock.RUnlock()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, entry := range entries {
+		err := fn(entry)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+func (c *BoltCache) Expires(key Key) (time.Time, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var expires time.Time
+	err := c.db.View(func(tx *bolt.Tx) error {
+		record := tx.Bucket(boltBucket).Get([]byte(key.String()))
+		if record == nil {
+			return nil
+		}
+		entry, err := decodeBoltEntry(record)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		expires = entry.expires
+		return nil
+	})
+	if err != nil {
+		return time.Time{}, errors.WithStack(err)
+	}
+
+	return expires, nil
+}
+
+func (c *BoltCache) Delete(key Key) error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(key.String()))
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// DeletePrefix deletes all matching entries in a single transaction.
+func (c *BoltCache) DeletePrefix(prefix string) (int, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	deleted := 0
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltBucket).Cursor()
+		for k, _ := cursor.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = cursor.Seek([]byte(prefix)) {
+			err := cursor.Delete()
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			deleted++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	return deleted, nil
+}
+
+func (c *BoltCache) runCompactor() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.config.CompactionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := c.Compact(false)
+			if err != nil {
+				log.WithError(err).WithField("path", c.path.String()).Error("Failed to compact cache database")
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Compact deletes expired entries and, if much of the database file is then unused or force is set,
+// rewrites the database into a new file that replaces it.
+//
+// It is called periodically if the config sets a CompactionInterval, but may also be called directly.
+// The cache can't be used while the database is rewritten.
+func (c *BoltCache) Compact(force bool) error {
+	err := c.deleteExpired()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stat, err := os.Stat(c.path.String())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	stats := c.db.Stats()
+	unused := int64(stats.FreePageN+stats.PendingPageN) * int64(c.db.Info().PageSize)
+	if !force && float64(unused) < float64(stat.Size())*compactionRatio {
+		return nil
+	}
+
+	compactPath := c.path.String() + compactSuffix
+	err = c.copyTo(compactPath)
+	if err != nil {
+		os.Remove(compactPath)
+		return errors.WithStack(err)
+	}
+
+	// The rename is atomic, so a crash leaves either the old or the compacted database.
+	err = c.db.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = os.Rename(compactPath, c.path.String())
+	if err != nil {
+		os.Remove(compactPath)
+	}
+
+	// Reopen even if the rename failed, so the cache keeps working with the old database.
+	db, openErr := openBolt(c.path.String(), c.config)
+	if openErr != nil {
+		return errors.WithStack(openErr) // Until restarted, the cache fails with bolt.ErrDatabaseNotOpen.
+	}
+	c.db = db
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	log.WithFields(log.Fields{"path": c.path.String(), "before": stat.Size()}).Info("Compacted cache database")
+	return nil
+}
+
+// copyTo copies all entries to a new database file. The lock must be held.
+func (c *BoltCache) copyTo(path string) error {
+	dst, err := openBolt(path, c.config)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer dst.Close()
+
+	return c.db.View(func(src *bolt.Tx) error {
+		cursor := src.Bucket(boltBucket).Cursor()
+		k, v := cursor.First()
+		for k != nil {
+
+			// Copied in batches, so the transactions don't get too large.
+			err := dst.Update(func(tx *bolt.Tx) error {
+				bucket := tx.Bucket(boltBucket)
+				bucket.FillPercent = 1 // Keys are inserted in order, so pages can be filled completely.
+				for n := 0; k != nil && n < 1000; n++ {
+					err := bucket.Put(k, v)
+					if err != nil {
+						return errors.WithStack(err)
+					}
+					k, v = cursor.Next()
+				}
+				return nil
+			})
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		return nil
+	})
+}
+
+// deleteExpired deletes all expired entries.
+func (c *BoltCache) deleteExpired() error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+
+		// Keys are collected first, since deleting moves the cursor.
+		var keys [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			entry, err := decodeBoltEntry(v)
+			if err != nil || expired(entry.expires) {
+				keys = append(keys, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		for _, k := range keys {
+			err := bucket.Delete(k)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		return nil
+	})
+}
+
+// boltEntry is the decoded value of a key in the database.
+//
+// It's encoded as the expiry time in nanoseconds since the Unix epoch or zero (8 bytes, big endian),
+// the length of the version (uvarint), the version, and the value.
+type boltEntry struct {
+	version string
+	expires time.Time
+	value   []byte
+}
+
+func encodeBoltEntry(entry boltEntry) []byte {
+	buf := make([]byte, 8+binary.MaxVarintLen64+len(entry.version)+len(entry.value))
+	if !entry.expires.IsZero() {
+		binary.BigEndian.PutUint64(buf, uint64(entry.expires.UnixNano()))
+	}
+	n := 8 + binary.PutUvarint(buf[8:], uint64(len(entry.version)))
+	n += copy(buf[n:], entry.version)
+	n += copy(buf[n:], entry.value)
+	return buf[:n]
+}
+
+// decodeBoltEntry decodes a value of the database. The returned value points into buf.
+func decodeBoltEntry(buf []byte) (boltEntry, error) {
+	if len(buf) < 8 {
+		return boltEntry{}, errors.New("Corrupt cache: truncated entry")
+	}
+	var entry boltEntry
+	if expires := int64(binary.BigEndian.Uint64(buf)); expires != 0 {
+		entry.expires = time.Unix(0, expires)
+	}
+
+	length, n := binary.Uvarint(buf[8:])
+	if n <= 0 || uint64(len(buf)-8-n) < length {
+		return boltEntry{}, errors.New("Corrupt cache: truncated entry")
+	}
+	start := 8 + n
+	entry.version = string(buf[start : start+int(length)])
+	entry.value = buf[start+int(length):]
+	return entry, nil
+}
@@ -0,0 +1,146 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+
+	"github.com/fxkr/openview/backend/util/safe"
+)
+
+func TestBoltCache(t *testing.T) {
+	_ = Suite(&BoltCacheSuite{})
+	TestingT(t)
+}
+
+type BoltCacheSuite struct {
+	dir  safe.Path
+	path safe.Path
+}
+
+func (s *BoltCacheSuite) SetUpTest(c *C) {
+	dir, err := ioutil.TempDir("", "openview-test")
+	if err != nil {
+		c.Fatalf("Error: %+v", errors.WithStack(err))
+	}
+	s.dir = safe.UnsafeNewPath(dir)
+	s.path = s.dir.JoinUnsafe("metadata.db")
+}
+
+func (s *BoltCacheSuite) TearDownTest(c *C) {
+	os.RemoveAll(s.dir.String())
+}
+
+func (s *BoltCacheSuite) failFill() (Version, []byte, error) {
+	return nil, nil, errors.New("Unexpected cache miss")
+}
+
+func (s *BoltCacheSuite) TestPersistence(c *C) {
+	bc, err := NewBoltCache(s.path, BoltCacheConfig{})
+	c.Assert(err, IsNil)
+	value, err := bc.GetBytes(safe.NewKey("a"), safe.NewKey("v1"), func() (Version, []byte, error) {
+		return safe.NewKey("v1"), []byte("value"), nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "value")
+	c.Assert(bc.PutTTL(safe.NewKey("b"), safe.NewKey("v1"), []byte("value"), time.Millisecond), IsNil)
+	bc.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	bc, err = NewBoltCache(s.path, BoltCacheConfig{})
+	c.Assert(err, IsNil)
+	defer bc.Close()
+
+	value, err = bc.GetBytes(safe.NewKey("a"), safe.NewKey("v1"), s.failFill)
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "value")
+
+	_, err = bc.GetBytes(safe.NewKey("b"), safe.NewKey("v1"), s.failFill)
+	c.Assert(err, NotNil) // Expired
+	_, err = bc.GetBytes(safe.NewKey("a"), safe.NewKey("v2"), s.failFill)
+	c.Assert(err, NotNil) // Outdated
+}
+
+func (s *BoltCacheSuite) TestReadOnly(c *C) {
+	bc, err := NewBoltCache(s.path, BoltCacheConfig{})
+	c.Assert(err, IsNil)
+	c.Assert(bc.Put(safe.NewKey("a"), safe.NewKey("v1"), []byte("value")), IsNil)
+
+	// Still open for writing
+	_, err = NewBoltCache(s.path, BoltCacheConfig{ReadOnly: true, Timeout: 10 * time.Millisecond})
+	c.Assert(err, ErrorMatches, "Cache database is in use by another process: .*")
+	bc.Close()
+
+	bc, err = NewBoltCache(s.path, BoltCacheConfig{ReadOnly: true})
+	c.Assert(err, IsNil)
+	defer bc.Close()
+
+	value, err := bc.GetBytes(safe.NewKey("a"), safe.NewKey("v1"), s.failFill)
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "value")
+	c.Assert(bc.Put(safe.NewKey("b"), safe.NewKey("v1"), []byte("value")), NotNil)
+}
+
+func (s *BoltCacheSuite) TestDeletePrefix(c *C) {
+	bc, err := NewBoltCache(s.path, BoltCacheConfig{})
+	c.Assert(err, IsNil)
+	defer bc.Close()
+
+	for _, key := range []safe.Key{
+		safe.NewKey("imagemeta", "album/a.jpg"),
+		safe.NewKey("imagemeta", "album/b.jpg"),
+		safe.NewKey("imagemeta", "other/a.jpg"),
+	} {
+		c.Assert(bc.Put(key, safe.NewKey("v1"), []byte("value")), IsNil)
+	}
+
+	deleted, err := bc.DeletePrefix(safe.NewKeyPrefix("imagemeta", "album/"))
+	c.Assert(err, IsNil)
+	c.Assert(deleted, Equals, 2)
+
+	var entries []Entry
+	c.Assert(bc.Walk("", func(entry Entry) error {
+		entries = append(entries, entry)
+		return bc.Delete(entry.Key)
+	}), IsNil)
+	c.Assert(entries, DeepEquals, []Entry{{Raw(safe.NewKey("imagemeta", "other/a.jpg").String()), safe.NewKey("v1").String(), 5, time.Time{}}})
+
+	deleted, err = bc.DeletePrefix("")
+	c.Assert(err, IsNil)
+	c.Assert(deleted, Equals, 0)
+}
+
+func (s *BoltCacheSuite) TestCompact(c *C) {
+	c.Assert(ioutil.WriteFile(s.path.String()+compactSuffix, []byte("interrupted"), 0644), IsNil)
+
+	bc, err := NewBoltCache(s.path, BoltCacheConfig{})
+	c.Assert(err, IsNil)
+	defer bc.Close()
+
+	_, err = os.Stat(s.path.String() + compactSuffix)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	value := make([]byte, 10000)
+	for i := 0; i < 200; i++ {
+		c.Assert(bc.Put(safe.NewKey("a", i), safe.NewKey("v1"), value), IsNil)
+	}
+	deleted, err := bc.DeletePrefix(safe.NewKeyPrefix("a"))
+	c.Assert(err, IsNil)
+	c.Assert(deleted, Equals, 200)
+	c.Assert(bc.Put(safe.NewKey("b"), safe.NewKey("v1"), []byte("value")), IsNil)
+
+	before, err := os.Stat(s.path.String())
+	c.Assert(err, IsNil)
+	c.Assert(bc.Compact(false), IsNil)
+	after, err := os.Stat(s.path.String())
+	c.Assert(err, IsNil)
+	c.Assert(after.Size() < before.Size(), Equals, true)
+
+	result, err := bc.GetBytes(safe.NewKey("b"), safe.NewKey("v1"), s.failFill)
+	c.Assert(err, IsNil)
+	c.Assert(string(result), Equals, "value")
+}
@@ -1,7 +1,14 @@
 package cache
 
 import (
+	"bytes"
+	"io"
 	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/fxkr/openview/backend/util/handler"
 )
 
 // Key address a value in a Cache.
@@ -23,6 +30,11 @@ type Cache interface {
 	// Put sets a value in the cache.
 	Put(key Key, version Version, value []byte) error
 
+	// PutTTL sets a value in the cache that expires after ttl. A ttl of zero means it never expires.
+	//
+	// Expired values are treated as missing.
+	PutTTL(key Key, version Version, value []byte, ttl time.Duration) error
+
 	// GetBytes does a cache lookup and, if necessary, fill.
 	//
 	// If the cache has the key, and the version matches, the cached value will be returned.
@@ -42,9 +54,110 @@ type Cache interface {
 	// Specific implementations may document their own behavior.
 	GetHandler(key Key, version Version, filler func() (Version, []byte, error), contentType string) (http.Handler, error)
 
+	// PutStream sets a value read from r in the cache, like PutTTL.
+	PutStream(key Key, version Version, r io.Reader, ttl time.Duration) error
+
+	// GetStream does a cache lookup and, if necessary, fill, like GetBytes, but without holding the value in memory
+	// where the implementation allows it.
+	//
+	// The filler writes the value to a temporary file or buffer. The returned reader must be closed.
+	GetStream(key Key, version Version, filler StreamFiller) (io.ReadCloser, error)
+
+	// GetStreamHandler does a cache lookup and, if necessary, fill, like GetHandler, but with a streaming filler.
+	//
+	// The http.Handler may hold resources until it is called, so it must be called once.
+	GetStreamHandler(key Key, version Version, filler StreamFiller, contentType string) (http.Handler, error)
+
+	// Expires returns when a value expires, or the zero time if it doesn't or isn't cached.
+	Expires(key Key) (time.Time, error)
+
+	// Delete removes a value from the cache. Deleting a missing value is not an error.
+	Delete(key Key) error
+
+	// DeletePrefix removes all values whose key starts with prefix, and returns how many were removed.
+	//
+	// See safe.NewKeyPrefix for building prefixes.
+	DeletePrefix(prefix string) (int, error)
+
+	// Walk calls fn for each value whose key starts with prefix, stopping at the first error.
+	// An empty prefix visits all values.
+	//
+	// Expired values are skipped. Values may be deleted by fn.
+	// Values added or deleted concurrently may or may not be visited.
+	Walk(prefix string, fn func(Entry) error) error
+
 	// Close terminates open connections.
 	//
 	// The behavior of Close after the first call is undefined.
 	// Specific implementations may document their own behavior.
 	Close()
 }
+
+// StreamFiller writes a value to w and returns its version.
+type StreamFiller func(w io.Writer) (Version, error)
+
+// Entry describes a cached value.
+type Entry struct {
+	Key     Key
+	Version string
+	Size    int64
+
+	// Expires is when the value expires, or the zero time if it doesn't.
+	Expires time.Time
+}
+
+// Raw is a Key or Version given by its string form, e.g. one read back from a cache.
+type Raw string
+
+func (r Raw) String() string {
+	return string(r)
+}
+
+// expiry returns when a value put now with ttl expires, or the zero time if it doesn't.
+func expiry(ttl time.Duration) time.Time {
+	if ttl == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+// expired returns true if a value that expires at expires has expired.
+func expired(expires time.Time) bool {
+	return !expires.IsZero() && !time.Now().Before(expires)
+}
+
+// deletePrefix implements DeletePrefix using Walk and Delete.
+func deletePrefix(c Cache, prefix string) (int, error) {
+	deleted := 0
+	err := c.Walk(prefix, func(entry Entry) error {
+		err := c.Delete(entry.Key)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		deleted++
+		return nil
+	})
+	if err != nil {
+		return deleted, errors.WithStack(err)
+	}
+	return deleted, nil
+}
+
+// validators returns the validators of responses with the content identified by version.
+//
+// There's no Last-Modified, since versions can cover more than modification times, like the settings of renditions.
+func validators(version Version) handler.Validators {
+	return handler.Validators{ETag: handler.ETag(version.String())}
+}
+
+// buffered adapts a StreamFiller for caches that hold values in memory anyway.
+func buffered(filler StreamFiller) func() (Version, []byte, error) {
+	return func() (Version, []byte, error) {
+		var buf bytes.Buffer
+		version, err := filler(&buf)
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		return version, buf.Bytes(), nil
+	}
+}
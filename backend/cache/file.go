@@ -2,15 +2,23 @@ package cache
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dchest/safefile"
 	"github.com/pkg/errors"
 	"github.com/pkg/xattr"
+	log "github.com/sirupsen/logrus"
 
 	"github.com/fxkr/openview/backend/util/handler"
 	"github.com/fxkr/openview/backend/util/safe"
@@ -18,10 +26,52 @@ import (
 
 // FileCache is Cache implementation that stores keys as files in a directory.
 //
-// Metadata (currently only the version, used for expiration) is stored in extended attributes,
-// so the filesystem needs to support these. Nearly all Linux filesystems do.
+// Files are named after the SHA-256 hash of their key, and sharded into two levels of subdirectories
+// by its first bytes. Metadata (the key itself, the version and the optional expiry time) is stored in
+// extended attributes. Nearly all Linux filesystems support these. On those that don't,
+// it's stored in a header in front of the value instead.
+//
+// If the config sets limits, a background evictor deletes the least recently used entries
+// whenever they are exceeded.
 type FileCache struct {
-	path safe.Path
+	path   safe.Path
+	config FileCacheConfig
+
+	// header is true if metadata is stored in headers rather than extended attributes.
+	header bool
+
+	// lock is held for reading while entries are committed and for writing while they are evicted,
+	// so the evictor never deletes an entry that was replaced since it was scanned.
+	lock sync.RWMutex
+
+	// evicting serializes evictions, which would otherwise evict too much.
+	evicting sync.Mutex
+
+	// size and entries estimate the total size and number of entries. Each eviction recounts them.
+	// The evictor only walks the cache directory when they exceed the limits, or to recount them periodically.
+	size    int64
+	entries int64
+
+	evict chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+type FileCacheConfig struct {
+
+	// MaxSize is the largest total size of all entries in bytes. Zero means no limit.
+	MaxSize int64 `json:"max_size"`
+
+	// MaxEntries is the largest number of entries. Zero means no limit.
+	MaxEntries int64 `json:"max_entries"`
+
+	// EvictionInterval is how often the limits are checked. Zero means once a minute.
+	// The cache directory is recounted every 60 intervals.
+	EvictionInterval time.Duration `json:"eviction_interval"`
+
+	// Metadata is where metadata is stored: FileCacheMetadataXattr, FileCacheMetadataHeader,
+	// or FileCacheMetadataAuto to use extended attributes if the filesystem supports them.
+	Metadata string `json:"metadata"`
 }
 
 // Statically assert that *FileCache implements Cache.
@@ -32,7 +82,13 @@ var _ Cache = (*FileCache)(nil)
 // Names of extended attributes used by userspace tools must start with "user.".
 const versionXattr = "user.openview.cache-version"
 
-func NewFileCache(path safe.Path) (*FileCache, error) {
+// keyXattr is the name of the extended attribute used to store the cache item key.
+const keyXattr = "user.openview.cache-key"
+
+// expiresXattr is the name of the extended attribute used to store when the cache item expires, if it does.
+const expiresXattr = "user.openview.cache-expires"
+
+func NewFileCache(path safe.Path, config FileCacheConfig) (*FileCache, error) {
 
 	stat, err := os.Stat(path.String())
 	if err != nil {
@@ -41,53 +97,131 @@ func NewFileCache(path safe.Path) (*FileCache, error) {
 	if !stat.IsDir() {
 		return nil, errors.Errorf("Cache directory does not exist: %v", path.String())
 	}
-	if !xattr.Supported(path.String()) {
-		return nil, errors.Errorf("Cache directorie's file system does not support extended attributes: %v", path.String())
+	header, err := useHeader(path.String(), config.Metadata)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if config.EvictionInterval == 0 {
+		config.EvictionInterval = time.Minute
+	}
+
+	c := &FileCache{
+		path:   path,
+		config: config,
+		header: header,
+		evict:  make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	if !c.header {
+		err = c.migrate()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	if c.limited() {
+		go c.runEvictor()
+	} else {
+		close(c.done)
 	}
 
-	return &FileCache{path}, nil
+	return c, nil
 }
 
 func (c *FileCache) Put(key Key, version Version, buffer []byte) error {
+	return c.PutTTL(key, version, buffer, 0)
+}
+
+func (c *FileCache) PutTTL(key Key, version Version, buffer []byte, ttl time.Duration) error {
+	return c.PutStream(key, version, bytes.NewReader(buffer), ttl)
+}
+
+func (c *FileCache) PutStream(key Key, version Version, r io.Reader, ttl time.Duration) error {
+	_, err := c.create(key, ttl, func(w io.Writer) (Version, error) {
+		_, err := io.Copy(w, r)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return version, nil
+	}, false)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// create fills an entry through a temporary file, which replaces the entry once complete.
+//
+// With open, the new entry is also opened for reading.
+func (c *FileCache) create(key Key, ttl time.Duration, filler StreamFiller, open bool) (*os.File, error) {
 
 	// Created temporary file
-	// (Same directory, so move will be atomic and xattrs won't get lost.)
+	// (Same directory, so move will be atomic and metadata won't get lost.)
 	filePath := c.getFilePath(key)
+	err := os.MkdirAll(filepath.Dir(filePath.String()), 0755)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
 	f, err := safefile.Create(filePath.String(), 0644)
 	if err != nil {
-		return errors.WithStack(err)
+		return nil, errors.WithStack(err)
 	}
 	defer f.Close()
 
-	// Write to temporary file
-	n, _ := f.Write(buffer)
-	if n < len(buffer) {
-		return errors.WithStack(io.ErrShortWrite)
+	// Write value, version, key and expiry to temporary file
+	err = c.writeEntry(f, key, ttl, filler)
+	if err != nil {
+		return nil, errors.WithStack(err) // Closing deletes the temporary file
 	}
-
-	// Store version as extended attribute
-	err = xattr.Set(f.Name(), versionXattr, []byte(version.String()))
+	stat, err := f.Stat()
 	if err != nil {
-		f.Close() // Deletes the temporary file
-		return errors.WithStack(err)
+		return nil, errors.WithStack(err)
+	}
+
+	// Opened before committing, so it's still the new entry if it's replaced or evicted right away.
+	var result *os.File
+	if open {
+		result, err = os.Open(f.Name())
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
 	}
 
 	// Atomically move temporary file to final location
+	c.lock.RLock()
 	err = f.Commit()
+	c.lock.RUnlock()
 	if err != nil {
-		return errors.WithStack(err)
+		if result != nil {
+			result.Close()
+		}
+		return nil, errors.WithStack(err)
 	}
 
-	return nil
+	// Replacing an entry is counted as adding one. That only makes the next eviction happen sooner.
+	size := atomic.AddInt64(&c.size, stat.Size())
+	entries := atomic.AddInt64(&c.entries, 1)
+	if c.exceeds(size, entries) {
+		select {
+		case c.evict <- struct{}{}:
+		default: // Already pending
+		}
+	}
+
+	return result, nil
 }
 
 func (c *FileCache) GetBytes(key Key, version Version, filler func() (Version, []byte, error)) ([]byte, error) {
 	file := c.getFilePath(key)
 
-	err := c.checkFile(file, version)
+	cachedValue, err := c.readValue(file.String(), version)
 	if err == nil {
 		// Cache hit
-		return ioutil.ReadFile(file.String())
+		c.touch(file)
+		return cachedValue, nil
 	}
 
 	version, value, err := filler()
@@ -106,10 +240,12 @@ func (c *FileCache) GetBytes(key Key, version Version, filler func() (Version, [
 func (c *FileCache) GetHandler(key Key, version Version, filler func() (Version, []byte, error), contentType string) (http.Handler, error) {
 	file := c.getFilePath(key)
 
-	err := c.checkFile(file, version)
+	// Served from the file opened for the check, so an entry replaced in between can't be served with these validators.
+	stream, err := c.openEntry(file.String(), version)
 	if err == nil {
 		// Cache hit
-		return &handler.FileHandler{Path: file}, nil // Cache hit
+		c.touch(file)
+		return &handler.ReaderHandler{Reader: stream, ContentType: contentType, Validators: validators(version)}, nil
 	}
 
 	version, value, err := filler()
@@ -125,37 +261,199 @@ func (c *FileCache) GetHandler(key Key, version Version, filler func() (Version,
 	return &handler.ByteHandler{
 		Bytes:       value,
 		ContentType: contentType,
+		Validators:  validators(version),
 	}, nil
 }
 
+// GetStream returns the entry's file on a hit. On a miss, the filler writes straight to a temporary file,
+// which becomes the entry and is returned.
+func (c *FileCache) GetStream(key Key, version Version, filler StreamFiller) (io.ReadCloser, error) {
+	file := c.getFilePath(key)
+
+	stream, err := c.openEntry(file.String(), version)
+	if err == nil {
+		// Cache hit
+		c.touch(file)
+		return stream, nil
+	}
+
+	f, err := c.create(key, 0, filler, true)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	stream, _, err = c.newFileStream(f)
+	if err != nil {
+		f.Close()
+		return nil, errors.WithStack(err)
+	}
+	return stream, nil
+}
+
+// GetStreamHandler serves the entry's open file with http.ServeContent, on a hit as well as on a miss.
+func (c *FileCache) GetStreamHandler(key Key, version Version, filler StreamFiller, contentType string) (http.Handler, error) {
+	stream, err := c.GetStream(key, version, filler)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &handler.ReaderHandler{Reader: stream, ContentType: contentType, Validators: validators(version)}, nil
+}
+
 func (c *FileCache) getFileName(key Key) safe.RelativePath {
-	unsafeFilename := key.String()
-	safeFilename := base64.URLEncoding.EncodeToString([]byte(unsafeFilename))
-	return safe.UnsafeNewRelativePath(safeFilename)
+	hash := sha256.Sum256([]byte(key.String()))
+	name := hex.EncodeToString(hash[:])
+	return safe.UnsafeNewRelativePath(filepath.Join(name[0:2], name[2:4], name))
 }
 
 func (c *FileCache) getFilePath(key Key) safe.Path {
 	return c.path.Join(c.getFileName(key))
 }
 
-func (c *FileCache) checkFile(file safe.Path, requestedVersion Version) error {
-	stat, err := os.Stat(file.String())
+// migrate moves entries of the old flat layout, which were named after their base64 encoded key, into shards.
+func (c *FileCache) migrate() error {
+	fileInfos, err := ioutil.ReadDir(c.path.String())
 	if err != nil {
 		return errors.WithStack(err)
 	}
+
+	migrated := 0
+	for _, fileInfo := range fileInfos {
+		if !fileInfo.Mode().IsRegular() || strings.HasSuffix(fileInfo.Name(), tempSuffix) {
+			continue
+		}
+		key, err := base64.URLEncoding.DecodeString(fileInfo.Name())
+		if err != nil {
+			continue // Not a cache entry
+		}
+
+		oldPath := c.path.JoinUnsafe(fileInfo.Name()).String()
+		newPath := c.getFilePath(Raw(key)).String()
+
+		err = xattr.Set(oldPath, keyXattr, key)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = os.MkdirAll(filepath.Dir(newPath), 0755)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = os.Rename(oldPath, newPath)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		migrated++
+	}
+
+	if migrated > 0 {
+		log.WithFields(log.Fields{"path": c.path.String(), "entries": migrated}).Info("Migrated cache to sharded layout")
+	}
+
+	return nil
+}
+
+// isEntry returns true for files that may be entries. Files directly in the cache directory,
+// like the database of a BoltCache sharing it, are not.
+func (c *FileCache) isEntry(path string, stat os.FileInfo) bool {
+	return stat.Mode().IsRegular() &&
+		!strings.HasSuffix(stat.Name(), tempSuffix) &&
+		filepath.Dir(path) != filepath.Clean(c.path.String())
+}
+
+// checkFile returns the offset of the value in an entry if it has the requested version and hasn't expired.
+func (c *FileCache) checkFile(file string, requestedVersion Version) (int64, error) {
+	stat, err := os.Stat(file)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
 	if !stat.Mode().IsRegular() {
-		return errors.Errorf("Corrupt cache: not a regular file: %s", file.String())
+		return 0, errors.Errorf("Corrupt cache: not a regular file: %s", file)
 	}
-	cachedVersion, err := xattr.Get(file.String(), versionXattr)
+	header, offset, err := c.readMetadata(file)
 	if err != nil {
-		return errors.Errorf("Failed to read extended attributes: %s", file.String())
+		return 0, errors.WithStack(err)
 	}
-	if !bytes.Equal(cachedVersion, []byte(requestedVersion.String())) {
-		return errors.Errorf("Outdated cache item: %s", file.String())
+	if header.Version != requestedVersion.String() {
+		return 0, errors.Errorf("Outdated cache item: %s", file)
 	}
-	return nil
+	if expired(header.expires()) {
+		return 0, errors.Errorf("Expired cache item: %s", file)
+	}
+	return offset, nil
 }
 
+// Close stops the evictor.
 func (c *FileCache) Close() {
+	close(c.stop)
+	<-c.done
+}
+
+// Walk reads the metadata of all entries, so it's slow even with a prefix. Expired entries are deleted on the way.
+func (c *FileCache) Walk(prefix string, fn func(Entry) error) error {
+	err := filepath.Walk(c.path.String(), func(path string, stat os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil // Deleted during the walk
+		} else if err != nil {
+			return errors.WithStack(err)
+		}
+		if !c.isEntry(path, stat) {
+			return nil
+		}
+
+		header, offset, err := c.readMetadata(path)
+		if err != nil {
+			return nil // Deleted since, or not a cache entry
+		}
+
+		if expired(header.expires()) {
+			_, err = c.remove(path, stat)
+			return err
+		}
+		if !strings.HasPrefix(header.Key, prefix) {
+			return nil
+		}
+
+		return fn(Entry{
+			Key:     Raw(header.Key),
+			Version: header.Version,
+			Size:    stat.Size() - offset,
+			Expires: header.expires(),
+		})
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+func (c *FileCache) Expires(key Key) (time.Time, error) {
+	file := c.getFilePath(key).String()
+
+	_, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, errors.WithStack(err)
+	}
+
+	header, _, err := c.readMetadata(file)
+	if err != nil {
+		return time.Time{}, errors.WithStack(err)
+	}
+	return header.expires(), nil
+}
+
+func (c *FileCache) Delete(key Key) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	err := os.Remove(c.getFilePath(key).String())
+	if err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
 
+func (c *FileCache) DeletePrefix(prefix string) (int, error) {
+	return deletePrefix(c, prefix)
 }
@@ -0,0 +1,206 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/xattr"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/fxkr/openview/backend/util/safe"
+)
+
+// accessXattr is the name of the extended attribute storing when a cache item was last read (Unix time).
+const accessXattr = "user.openview.cache-access"
+
+// accessResolution is how outdated an access time may get before a read updates it.
+// It saves a write for most reads of popular entries.
+const accessResolution = time.Minute
+
+// tempSuffix is the suffix of the temporary files of entries being written (see safefile).
+const tempSuffix = ".tmp"
+
+// evictionRatio is the fraction of the limits evictions reduce the cache to,
+// so there's room for new entries until the next eviction.
+const evictionRatio = 0.9
+
+// limited returns true if the cache has a size or entry limit.
+func (c *FileCache) limited() bool {
+	return c.config.MaxSize > 0 || c.config.MaxEntries > 0
+}
+
+// exceeds returns true if a cache of the given size and number of entries exceeds the limits.
+func (c *FileCache) exceeds(size int64, entries int64) bool {
+	return (c.config.MaxSize > 0 && size > c.config.MaxSize) ||
+		(c.config.MaxEntries > 0 && entries > c.config.MaxEntries)
+}
+
+// touch records that an entry was read. Errors are ignored, access times are only a hint.
+//
+// In header mode, the modification time is used as access time.
+func (c *FileCache) touch(file safe.Path) {
+	if !c.limited() {
+		return
+	}
+
+	now := time.Now()
+	if stat, err := os.Stat(file.String()); err == nil && now.Sub(c.getAccessTime(file.String(), stat)) < accessResolution {
+		return
+	}
+	if c.header {
+		_ = os.Chtimes(file.String(), now, now)
+	} else {
+		_ = xattr.Set(file.String(), accessXattr, []byte(strconv.FormatInt(now.Unix(), 10)))
+	}
+}
+
+// getAccessTime returns when an entry was last read, or written if it was never read.
+func (c *FileCache) getAccessTime(file string, stat os.FileInfo) time.Time {
+	if c.header {
+		return stat.ModTime()
+	}
+	buf, err := xattr.Get(file, accessXattr)
+	if err != nil {
+		return stat.ModTime()
+	}
+	unix, err := strconv.ParseInt(string(buf), 10, 64)
+	if err != nil {
+		return stat.ModTime()
+	}
+	return time.Unix(unix, 0)
+}
+
+// recountIntervals is how many eviction intervals pass between recounts of the cache directory.
+//
+// In between, the limits are checked against the estimates kept by Put, which don't notice deletions
+// or entries added by other processes.
+const recountIntervals = 60
+
+func (c *FileCache) runEvictor() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.config.EvictionInterval)
+	defer ticker.Stop()
+	recount := time.NewTicker(c.config.EvictionInterval * recountIntervals)
+	defer recount.Stop()
+
+	c.evictOrWarn()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			if !c.exceeds(atomic.LoadInt64(&c.size), atomic.LoadInt64(&c.entries)) {
+				continue
+			}
+		case <-recount.C:
+		case <-c.evict:
+		}
+		c.evictOrWarn()
+	}
+}
+
+func (c *FileCache) evictOrWarn() {
+	err := c.Evict()
+	if err != nil {
+		log.WithError(err).Warn("Failed to evict cache entries")
+	}
+}
+
+// Evict deletes the least recently used entries until the cache is within its limits.
+//
+// It walks the whole cache directory, recounting its size and entries. It is called when the estimates
+// exceed the limits and periodically to correct them, but may also be called directly.
+func (c *FileCache) Evict() error {
+	c.evicting.Lock()
+	defer c.evicting.Unlock()
+
+	type entry struct {
+		path     string
+		stat     os.FileInfo
+		accessed time.Time
+	}
+
+	var entries []entry
+	var size int64
+	err := filepath.Walk(c.path.String(), func(path string, stat os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil // Deleted during the walk
+		} else if err != nil {
+			return errors.WithStack(err)
+		}
+		if !c.isEntry(path, stat) {
+			return nil
+		}
+		entries = append(entries, entry{path, stat, c.getAccessTime(path, stat)})
+		size += stat.Size()
+		return nil
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	count := int64(len(entries))
+	atomic.StoreInt64(&c.size, size)
+	atomic.StoreInt64(&c.entries, count)
+
+	if !c.exceeds(size, count) {
+		return nil
+	}
+
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].accessed.Before(entries[b].accessed)
+	})
+
+	maxSize := int64(float64(c.config.MaxSize) * evictionRatio)
+	maxEntries := int64(float64(c.config.MaxEntries) * evictionRatio)
+	for _, e := range entries {
+		if (c.config.MaxSize <= 0 || size <= maxSize) && (c.config.MaxEntries <= 0 || count <= maxEntries) {
+			break
+		}
+
+		removed, err := c.remove(e.path, e.stat)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if removed {
+			size -= e.stat.Size()
+			count--
+		}
+	}
+
+	atomic.StoreInt64(&c.size, size)
+	atomic.StoreInt64(&c.entries, count)
+
+	return nil
+}
+
+// remove deletes an entry, unless it was replaced or deleted since it was scanned.
+func (c *FileCache) remove(path string, scanned os.FileInfo) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stat, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.WithStack(err)
+	}
+	if !os.SameFile(stat, scanned) {
+		return false, nil
+	}
+
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	return true, nil
+}
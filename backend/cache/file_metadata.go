@@ -0,0 +1,296 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/dchest/safefile"
+	"github.com/pkg/errors"
+	"github.com/pkg/xattr"
+)
+
+// Values of FileCacheConfig.Metadata.
+const (
+	FileCacheMetadataAuto   = ""
+	FileCacheMetadataXattr  = "xattr"
+	FileCacheMetadataHeader = "header"
+)
+
+// headerMagic starts the header of entries in header mode.
+const headerMagic = "openview-cache-entry\n"
+
+// fileHeader is the metadata of an entry in header mode.
+//
+// It's stored as a line of JSON after headerMagic, in front of the value.
+type fileHeader struct {
+	Key     string `json:"key"`
+	Version string `json:"version"`
+
+	// Expires is when the entry expires in nanoseconds since the Unix epoch, or zero if it doesn't.
+	Expires int64 `json:"expires,omitempty"`
+}
+
+func (h *fileHeader) expires() time.Time {
+	if h.Expires == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, h.Expires)
+}
+
+// useHeader decides where metadata is stored.
+func useHeader(path string, metadata string) (bool, error) {
+	switch metadata {
+	case FileCacheMetadataAuto:
+		return !xattr.Supported(path), nil
+	case FileCacheMetadataXattr:
+		if !xattr.Supported(path) {
+			return false, errors.Errorf("Cache directorie's file system does not support extended attributes: %v", path)
+		}
+		return false, nil
+	case FileCacheMetadataHeader:
+		return true, nil
+	default:
+		return false, errors.Errorf("Bad cache metadata mode: %v", metadata)
+	}
+}
+
+// writeMetadata stores the key, version and expiry of an entry being written.
+//
+// In header mode, it must be called before the value is written.
+func (c *FileCache) writeMetadata(f *safefile.File, key Key, version Version, expires time.Time) error {
+	header := fileHeader{Key: key.String(), Version: version.String()}
+	if !expires.IsZero() {
+		header.Expires = expires.UnixNano()
+	}
+
+	if c.header {
+		line, err := json.Marshal(header)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = f.Write(append(append([]byte(headerMagic), line...), '\n'))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return nil
+	}
+
+	err := xattr.Set(f.Name(), versionXattr, []byte(version.String()))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = xattr.Set(f.Name(), keyXattr, []byte(key.String()))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if header.Expires != 0 {
+		err = xattr.Set(f.Name(), expiresXattr, []byte(strconv.FormatInt(header.Expires, 10)))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// writeEntry writes the value, and then the metadata, of an entry to a temporary file.
+//
+// The filler is given the underlying *os.File, so encoders that can write to files directly do.
+func (c *FileCache) writeEntry(f *safefile.File, key Key, ttl time.Duration, filler StreamFiller) error {
+	if !c.header {
+		version, err := filler(f.File)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return c.writeMetadata(f, key, version, expiry(ttl))
+	}
+
+	// The header goes first, but the version is only known once the value is written,
+	// so the value is spooled to another temporary file, which is never committed.
+	spool, err := safefile.Create(f.Name()+".spool", 0600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer spool.Close()
+
+	version, err := filler(spool.File)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = c.writeMetadata(f, key, version, expiry(ttl))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = spool.Seek(0, io.SeekStart)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = io.Copy(f, spool)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// readMetadata returns the key, version and expiry of an entry, and the offset of its value in the file.
+func (c *FileCache) readMetadata(file string) (*fileHeader, int64, error) {
+	if c.header {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, 0, errors.WithStack(err)
+		}
+		defer f.Close()
+		return decodeHeader(f)
+	}
+
+	key, err := xattr.Get(file, keyXattr)
+	if err != nil {
+		return nil, 0, errors.Errorf("Failed to read extended attributes: %s", file)
+	}
+	version, err := xattr.Get(file, versionXattr)
+	if err != nil {
+		return nil, 0, errors.Errorf("Failed to read extended attributes: %s", file)
+	}
+	header := &fileHeader{Key: string(key), Version: string(version)}
+
+	// Entries without expiry don't have the attribute.
+	expires, err := xattr.Get(file, expiresXattr)
+	if err == nil {
+		header.Expires, err = strconv.ParseInt(string(expires), 10, 64)
+		if err != nil {
+			return nil, 0, errors.Errorf("Corrupt cache: bad expiry: %s", file)
+		}
+	}
+	return header, 0, nil
+}
+
+// readValue returns the value of an entry if it has the requested version and hasn't expired.
+func (c *FileCache) readValue(file string, requestedVersion Version) ([]byte, error) {
+	if !c.header {
+		_, err := c.checkFile(file, requestedVersion)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return ioutil.ReadFile(file)
+	}
+
+	// Read the file only once, so the header and value can't be from different versions.
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	header, offset, err := decodeHeader(bytes.NewReader(buf))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if header.Version != requestedVersion.String() {
+		return nil, errors.Errorf("Outdated cache item: %s", file)
+	}
+	if expired(header.expires()) {
+		return nil, errors.Errorf("Expired cache item: %s", file)
+	}
+	return buf[offset:], nil
+}
+
+// decodeHeader reads the header of an entry in header mode, returning it and its length.
+func decodeHeader(r io.Reader) (*fileHeader, int64, error) {
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(headerMagic))
+	_, err := io.ReadFull(br, magic)
+	if err != nil || string(magic) != headerMagic {
+		return nil, 0, errors.New("Corrupt cache: missing header")
+	}
+
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return nil, 0, errors.New("Corrupt cache: truncated header")
+	}
+
+	var header fileHeader
+	err = json.Unmarshal(line, &header)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Corrupt cache: bad header")
+	}
+
+	return &header, int64(len(magic) + len(line)), nil
+}
+
+// fileStream reads the value of an open entry.
+type fileStream struct {
+	*io.SectionReader
+	file *os.File
+}
+
+func (s *fileStream) Close() error {
+	return s.file.Close()
+}
+
+// openEntry opens an entry at its value if it has the requested version and hasn't expired.
+func (c *FileCache) openEntry(file string, requestedVersion Version) (*fileStream, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	stream, header, err := c.newFileStream(f)
+	if err == nil && !c.header {
+		// Extended attributes are read by name, so check it still names the open file.
+		header, _, err = c.readMetadata(file)
+		if err == nil {
+			err = sameFile(f, file)
+		}
+	}
+	if err == nil && header.Version != requestedVersion.String() {
+		err = errors.Errorf("Outdated cache item: %s", file)
+	}
+	if err == nil && expired(header.expires()) {
+		err = errors.Errorf("Expired cache item: %s", file)
+	}
+	if err != nil {
+		f.Close()
+		return nil, errors.WithStack(err)
+	}
+
+	return stream, nil
+}
+
+// newFileStream returns a stream of the value of an open entry. In header mode, it also returns the header.
+func (c *FileCache) newFileStream(f *os.File) (*fileStream, *fileHeader, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	var header *fileHeader
+	var offset int64
+	if c.header {
+		header, offset, err = decodeHeader(io.NewSectionReader(f, 0, stat.Size()))
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+	}
+
+	return &fileStream{io.NewSectionReader(f, offset, stat.Size()-offset), f}, header, nil
+}
+
+// sameFile returns an error if path no longer names the open file f.
+func sameFile(f *os.File, path string) error {
+	openStat, err := f.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if !os.SameFile(openStat, stat) {
+		return errors.Errorf("Replaced cache item: %s", path)
+	}
+	return nil
+}
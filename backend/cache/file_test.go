@@ -0,0 +1,405 @@
+package cache
+
+import (
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/xattr"
+	. "gopkg.in/check.v1"
+
+	"github.com/fxkr/openview/backend/util/handler"
+	"github.com/fxkr/openview/backend/util/safe"
+)
+
+func TestFileCache(t *testing.T) {
+	_ = Suite(&FileCacheSuite{metadata: FileCacheMetadataXattr})
+	_ = Suite(&FileCacheSuite{metadata: FileCacheMetadataHeader})
+	TestingT(t)
+}
+
+// FileCacheSuite tests FileCache in one of its metadata modes.
+type FileCacheSuite struct {
+	metadata string
+
+	dir safe.Path
+}
+
+func (s *FileCacheSuite) SetUpTest(c *C) {
+	dir, err := ioutil.TempDir("", "openview-test")
+	if err != nil {
+		c.Fatalf("Error: %+v", errors.WithStack(err))
+	}
+	s.dir = safe.UnsafeNewPath(dir)
+}
+
+func (s *FileCacheSuite) TearDownTest(c *C) {
+	os.RemoveAll(s.dir.String())
+}
+
+func (s *FileCacheSuite) newFileCache(config FileCacheConfig) (*FileCache, error) {
+	config.Metadata = s.metadata
+	return NewFileCache(s.dir, config)
+}
+
+func (s *FileCacheSuite) fill(value string) func() (Version, []byte, error) {
+	return func() (Version, []byte, error) {
+		return safe.NewKey("v1"), []byte(value), nil
+	}
+}
+
+func (s *FileCacheSuite) failFill() (Version, []byte, error) {
+	return nil, nil, errors.New("Unexpected cache miss")
+}
+
+func (s *FileCacheSuite) TestGetBytes(c *C) {
+	fc, err := s.newFileCache(FileCacheConfig{})
+	c.Assert(err, IsNil)
+	defer fc.Close()
+
+	value, err := fc.GetBytes(safe.NewKey("a"), safe.NewKey("v1"), s.fill("value"))
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "value")
+
+	value, err = fc.GetBytes(safe.NewKey("a"), safe.NewKey("v1"), s.failFill)
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "value")
+
+	value, err = fc.GetBytes(safe.NewKey("a"), safe.NewKey("v2"), s.fill("new value"))
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "new value")
+}
+
+func (s *FileCacheSuite) TestLongKey(c *C) {
+	fc, err := s.newFileCache(FileCacheConfig{})
+	c.Assert(err, IsNil)
+	defer fc.Close()
+
+	key := safe.NewKey("thumbnail", strings.Repeat("album/", 100)+"image.jpg", "800")
+	c.Assert(fc.Put(key, safe.NewKey("v1"), []byte("value")), IsNil)
+
+	value, err := fc.GetBytes(key, safe.NewKey("v1"), s.failFill)
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "value")
+}
+
+func (s *FileCacheSuite) TestGetHandler(c *C) {
+	fc, err := s.newFileCache(FileCacheConfig{})
+	c.Assert(err, IsNil)
+	defer fc.Close()
+
+	c.Assert(fc.Put(safe.NewKey("a"), safe.NewKey("v1"), []byte("value")), IsNil)
+
+	h, err := fc.GetHandler(safe.NewKey("a"), safe.NewKey("v1"), s.failFill, "text/plain")
+	c.Assert(err, IsNil)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	c.Assert(w.Body.String(), Equals, "value")
+}
+
+func (s *FileCacheSuite) TestGetStream(c *C) {
+	fc, err := s.newFileCache(FileCacheConfig{})
+	c.Assert(err, IsNil)
+	defer fc.Close()
+
+	read := func(version string, value string) string {
+		r, err := fc.GetStream(safe.NewKey("a"), safe.NewKey(version), func(w io.Writer) (Version, error) {
+			c.Assert(value, Not(Equals), "", Commentf("Unexpected cache miss"))
+			_, err := io.WriteString(w, value)
+			return safe.NewKey(version), err
+		})
+		c.Assert(err, IsNil)
+		defer r.Close()
+		result, err := ioutil.ReadAll(r)
+		c.Assert(err, IsNil)
+		return string(result)
+	}
+
+	c.Assert(read("v1", "value"), Equals, "value")
+	c.Assert(read("v1", ""), Equals, "value")
+	c.Assert(read("v2", "new value"), Equals, "new value")
+
+	c.Assert(fc.PutStream(safe.NewKey("a"), safe.NewKey("v3"), strings.NewReader("streamed value"), 0), IsNil)
+	value, err := fc.GetBytes(safe.NewKey("a"), safe.NewKey("v3"), s.failFill)
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "streamed value")
+
+	// No temporary files are left behind
+	var files []string
+	c.Assert(filepath.Walk(s.dir.String(), func(path string, stat os.FileInfo, err error) error {
+		if err == nil && stat.Mode().IsRegular() {
+			files = append(files, path)
+		}
+		return err
+	}), IsNil)
+	c.Assert(files, DeepEquals, []string{fc.getFilePath(safe.NewKey("a")).String()})
+}
+
+func (s *FileCacheSuite) TestGetStreamHandler(c *C) {
+	fc, err := s.newFileCache(FileCacheConfig{})
+	c.Assert(err, IsNil)
+	defer fc.Close()
+
+	for range []int{0, 1} { // Miss, then hit
+		h, err := fc.GetStreamHandler(safe.NewKey("a"), safe.NewKey("v1"), func(w io.Writer) (Version, error) {
+			_, err := io.WriteString(w, "value")
+			return safe.NewKey("v1"), err
+		}, "text/plain")
+		c.Assert(err, IsNil)
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Range", "bytes=1-3")
+		h.ServeHTTP(w, r)
+		c.Assert(w.Code, Equals, http.StatusPartialContent)
+		c.Assert(w.Body.String(), Equals, "alu")
+	}
+}
+
+func (s *FileCacheSuite) TestGetHandlerValidators(c *C) {
+	fc, err := s.newFileCache(FileCacheConfig{})
+	c.Assert(err, IsNil)
+	defer fc.Close()
+
+	version := safe.NewKey("v1")
+
+	for range []int{0, 1} { // Miss, then hit
+		h, err := fc.GetHandler(safe.NewKey("a"), version, func() (Version, []byte, error) {
+			return version, []byte("value"), nil
+		}, "text/plain")
+		c.Assert(err, IsNil)
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		c.Assert(w.Code, Equals, http.StatusOK)
+		c.Assert(w.Header().Get("ETag"), Equals, handler.ETag(version.String()))
+		c.Assert(w.Header().Get("Last-Modified"), Equals, "")
+
+		w = httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("If-None-Match", handler.ETag(version.String()))
+		h.ServeHTTP(w, r)
+		c.Assert(w.Code, Equals, http.StatusNotModified)
+	}
+}
+
+func (s *FileCacheSuite) TestGetHandlerReplaced(c *C) {
+	fc, err := s.newFileCache(FileCacheConfig{})
+	c.Assert(err, IsNil)
+	defer fc.Close()
+
+	c.Assert(fc.Put(safe.NewKey("a"), safe.NewKey("v1"), []byte("old")), IsNil)
+	h, err := fc.GetHandler(safe.NewKey("a"), safe.NewKey("v1"), s.fill("unused"), "text/plain")
+	c.Assert(err, IsNil)
+
+	// Replaced between the lookup and serving, the handler still serves what its validators describe.
+	c.Assert(fc.Put(safe.NewKey("a"), safe.NewKey("version 2"), []byte("new value")), IsNil)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, "old")
+	c.Assert(w.Header().Get("ETag"), Equals, handler.ETag(safe.NewKey("v1").String()))
+}
+
+func (s *FileCacheSuite) TestWalk(c *C) {
+	fc, err := s.newFileCache(FileCacheConfig{})
+	c.Assert(err, IsNil)
+	defer fc.Close()
+
+	c.Assert(fc.Put(safe.NewKey("a"), safe.NewKey("v1"), []byte("value")), IsNil)
+
+	var entries []Entry
+	c.Assert(fc.Walk("", func(entry Entry) error {
+		entries = append(entries, entry)
+		return nil
+	}), IsNil)
+	c.Assert(entries, DeepEquals, []Entry{{Raw(safe.NewKey("a").String()), safe.NewKey("v1").String(), 5, time.Time{}}})
+
+	c.Assert(fc.Delete(safe.NewKey("a")), IsNil)
+	_, err = fc.GetBytes(safe.NewKey("a"), safe.NewKey("v1"), s.fill("new value"))
+	c.Assert(err, IsNil)
+}
+
+func (s *FileCacheSuite) TestTTL(c *C) {
+	fc, err := s.newFileCache(FileCacheConfig{})
+	c.Assert(err, IsNil)
+	defer fc.Close()
+
+	c.Assert(fc.PutTTL(safe.NewKey("a"), safe.NewKey("v1"), []byte("value"), time.Hour), IsNil)
+	c.Assert(fc.PutTTL(safe.NewKey("b"), safe.NewKey("v1"), []byte("value"), time.Millisecond), IsNil)
+	time.Sleep(10 * time.Millisecond)
+
+	_, err = fc.GetBytes(safe.NewKey("a"), safe.NewKey("v1"), s.failFill)
+	c.Assert(err, IsNil)
+	_, err = fc.GetHandler(safe.NewKey("b"), safe.NewKey("v1"), s.failFill, "text/plain")
+	c.Assert(err, NotNil)
+
+	var keys []string
+	c.Assert(fc.Walk("", func(entry Entry) error {
+		keys = append(keys, entry.Key.String())
+		c.Assert(entry.Expires.After(time.Now()), Equals, true)
+		return nil
+	}), IsNil)
+	c.Assert(keys, DeepEquals, []string{safe.NewKey("a").String()})
+
+	_, err = os.Stat(fc.getFilePath(safe.NewKey("b")).String())
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	expires, err := fc.Expires(safe.NewKey("a"))
+	c.Assert(err, IsNil)
+	c.Assert(expires.After(time.Now()), Equals, true)
+	expires, err = fc.Expires(safe.NewKey("b"))
+	c.Assert(err, IsNil)
+	c.Assert(expires.IsZero(), Equals, true)
+}
+
+func (s *FileCacheSuite) TestDeletePrefix(c *C) {
+	fc, err := s.newFileCache(FileCacheConfig{})
+	c.Assert(err, IsNil)
+	defer fc.Close()
+
+	for _, key := range []safe.Key{
+		safe.NewKey("thumbnail", "album/a.jpg", "800"),
+		safe.NewKey("thumbnail", "album/b.jpg", "800"),
+		safe.NewKey("thumbnail", "other/a.jpg", "800"),
+	} {
+		c.Assert(fc.Put(key, safe.NewKey("v1"), []byte("value")), IsNil)
+	}
+
+	deleted, err := fc.DeletePrefix(safe.NewKeyPrefix("thumbnail", "album/"))
+	c.Assert(err, IsNil)
+	c.Assert(deleted, Equals, 2)
+
+	var keys []string
+	c.Assert(fc.Walk(safe.NewKeyPrefix("thumbnail"), func(entry Entry) error {
+		keys = append(keys, entry.Key.String())
+		return nil
+	}), IsNil)
+	c.Assert(keys, DeepEquals, []string{safe.NewKey("thumbnail", "other/a.jpg", "800").String()})
+}
+
+func (s *FileCacheSuite) TestForeignFiles(c *C) {
+	foreign := s.dir.JoinUnsafe("metadata.db").String()
+	c.Assert(ioutil.WriteFile(foreign, []byte("database"), 0644), IsNil)
+
+	fc, err := s.newFileCache(FileCacheConfig{MaxEntries: 1, EvictionInterval: time.Hour})
+	c.Assert(err, IsNil)
+	defer fc.Close()
+
+	c.Assert(fc.Put(safe.NewKey("a"), safe.NewKey("v1"), []byte("value")), IsNil)
+	c.Assert(fc.Evict(), IsNil)
+	c.Assert(fc.Walk("", func(entry Entry) error {
+		c.Assert(entry.Key.String(), Equals, safe.NewKey("a").String())
+		return nil
+	}), IsNil)
+
+	_, err = os.Stat(foreign)
+	c.Assert(err, IsNil)
+}
+
+func (s *FileCacheSuite) TestMigrate(c *C) {
+	if s.metadata == FileCacheMetadataHeader {
+		c.Skip("The old layout needs extended attributes")
+	}
+
+	key := safe.NewKey("thumbnail", "image.jpg", "800")
+	oldPath := s.dir.JoinUnsafe(base64.URLEncoding.EncodeToString([]byte(key.String()))).String()
+	c.Assert(ioutil.WriteFile(oldPath, []byte("value"), 0644), IsNil)
+	c.Assert(xattr.Set(oldPath, versionXattr, []byte(safe.NewKey("v1").String())), IsNil)
+
+	fc, err := s.newFileCache(FileCacheConfig{})
+	c.Assert(err, IsNil)
+	defer fc.Close()
+
+	value, err := fc.GetBytes(key, safe.NewKey("v1"), s.failFill)
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "value")
+
+	var keys []string
+	c.Assert(fc.Walk("", func(entry Entry) error {
+		keys = append(keys, entry.Key.String())
+		return nil
+	}), IsNil)
+	c.Assert(keys, DeepEquals, []string{key.String()})
+}
+
+func (s *FileCacheSuite) TestEvictLeastRecentlyUsed(c *C) {
+	fc, err := s.newFileCache(FileCacheConfig{MaxEntries: 3, EvictionInterval: time.Hour})
+	c.Assert(err, IsNil)
+	defer fc.Close()
+
+	for i, name := range []string{"a", "b", "c"} {
+		key := safe.NewKey(name)
+		c.Assert(fc.Put(key, safe.NewKey("v1"), []byte(name)), IsNil)
+
+		written := time.Now().Add(time.Duration(i-10) * time.Hour)
+		c.Assert(os.Chtimes(fc.getFilePath(key).String(), written, written), IsNil)
+	}
+
+	// Reading the oldest entry makes it the most recently used one.
+	_, err = fc.GetBytes(safe.NewKey("a"), safe.NewKey("v1"), s.failFill)
+	c.Assert(err, IsNil)
+
+	c.Assert(fc.Put(safe.NewKey("d"), safe.NewKey("v1"), []byte("d")), IsNil)
+	c.Assert(fc.Evict(), IsNil)
+
+	for _, name := range []string{"a", "d"} {
+		_, err = fc.GetBytes(safe.NewKey(name), safe.NewKey("v1"), s.failFill)
+		c.Assert(err, IsNil, Commentf("%v was evicted", name))
+	}
+	for _, name := range []string{"b", "c"} {
+		_, err = fc.GetBytes(safe.NewKey(name), safe.NewKey("v1"), s.fill(name))
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *FileCacheSuite) TestEvictSize(c *C) {
+	fc, err := s.newFileCache(FileCacheConfig{MaxSize: 2500, EvictionInterval: time.Hour})
+	c.Assert(err, IsNil)
+	defer fc.Close()
+
+	for _, name := range []string{"a", "b", "c"} {
+		c.Assert(fc.Put(safe.NewKey(name), safe.NewKey("v1"), make([]byte, 1000)), IsNil)
+	}
+	c.Assert(fc.Evict(), IsNil)
+
+	c.Assert(atomic.LoadInt64(&fc.size) <= 2250, Equals, true)
+	c.Assert(atomic.LoadInt64(&fc.entries), Equals, int64(2))
+}
+
+func (s *FileCacheSuite) TestEvictOnlyOverEstimate(c *C) {
+	fc, err := s.newFileCache(FileCacheConfig{MaxEntries: 2, EvictionInterval: 5 * time.Millisecond})
+	c.Assert(err, IsNil)
+	defer fc.Close()
+	time.Sleep(20 * time.Millisecond) // Initial count
+
+	// Entries written by another process aren't counted until the next recount.
+	other, err := s.newFileCache(FileCacheConfig{})
+	c.Assert(err, IsNil)
+	defer other.Close()
+	for _, name := range []string{"a", "b", "c"} {
+		c.Assert(other.Put(safe.NewKey(name), safe.NewKey("v1"), []byte(name)), IsNil)
+	}
+
+	// So the periodic checks don't walk the cache directory.
+	time.Sleep(50 * time.Millisecond)
+	for _, name := range []string{"a", "b", "c"} {
+		_, err = fc.GetBytes(safe.NewKey(name), safe.NewKey("v1"), s.failFill)
+		c.Assert(err, IsNil, Commentf("%v was evicted", name))
+	}
+	c.Assert(atomic.LoadInt64(&fc.entries), Equals, int64(0))
+
+	c.Assert(fc.Evict(), IsNil)
+	c.Assert(atomic.LoadInt64(&fc.entries), Equals, int64(1))
+}
@@ -0,0 +1,224 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/fxkr/openview/backend/util/handler"
+)
+
+// MemoryCache is Cache implementation that keeps values in memory, evicting the least recently used
+// ones when it gets full.
+//
+// Values are stored and returned without copying, so they must not be modified.
+type MemoryCache struct {
+	config MemoryCacheConfig
+
+	mutex   sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+
+	// lru has the *memoryEntry values, most recently used first.
+	lru *list.List
+}
+
+type MemoryCacheConfig struct {
+
+	// MaxSize is the largest total size of all keys, versions and values in bytes. Zero means no limit.
+	MaxSize int64 `json:"max_size"`
+}
+
+type memoryEntry struct {
+	key     string
+	version string
+	value   []byte
+	expires time.Time
+}
+
+func (e *memoryEntry) size() int64 {
+	return int64(len(e.key) + len(e.version) + len(e.value))
+}
+
+// Statically assert that *MemoryCache implements Cache.
+var _ Cache = (*MemoryCache)(nil)
+
+func NewMemoryCache(config MemoryCacheConfig) *MemoryCache {
+	return &MemoryCache{
+		config:  config,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *MemoryCache) Put(key Key, version Version, value []byte) error {
+	return c.PutTTL(key, version, value, 0)
+}
+
+func (c *MemoryCache) PutTTL(key Key, version Version, value []byte, ttl time.Duration) error {
+	entry := &memoryEntry{key.String(), version.String(), value, expiry(ttl)}
+	if c.config.MaxSize > 0 && entry.size() > c.config.MaxSize {
+		return nil // Would evict everything else, and itself
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.remove(entry.key)
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += entry.size()
+
+	for c.config.MaxSize > 0 && c.size > c.config.MaxSize {
+		c.remove(c.lru.Back().Value.(*memoryEntry).key)
+	}
+
+	return nil
+}
+
+func (c *MemoryCache) GetBytes(key Key, version Version, filler func() (Version, []byte, error)) ([]byte, error) {
+	value, ok := c.get(key, version)
+	if ok {
+		return value, nil
+	}
+
+	version, value, err := filler()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	err = c.Put(key, version, value)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return value, nil
+}
+
+func (c *MemoryCache) GetHandler(key Key, version Version, filler func() (Version, []byte, error), contentType string) (http.Handler, error) {
+	bytes, err := c.GetBytes(key, version, filler)
+	if err != nil {
+		return nil, err
+	}
+
+	return &handler.ByteHandler{
+		Bytes:       bytes,
+		ContentType: contentType,
+		Validators:  validators(version),
+	}, nil
+}
+
+func (c *MemoryCache) PutStream(key Key, version Version, r io.Reader, ttl time.Duration) error {
+	value, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return c.PutTTL(key, version, value, ttl)
+}
+
+// GetStream buffers the value, since it's kept in memory anyway.
+func (c *MemoryCache) GetStream(key Key, version Version, filler StreamFiller) (io.ReadCloser, error) {
+	value, err := c.GetBytes(key, version, buffered(filler))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return ioutil.NopCloser(bytes.NewReader(value)), nil
+}
+
+func (c *MemoryCache) GetStreamHandler(key Key, version Version, filler StreamFiller, contentType string) (http.Handler, error) {
+	value, err := c.GetBytes(key, version, buffered(filler))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &handler.ReaderHandler{Reader: bytes.NewReader(value), ContentType: contentType, Validators: validators(version)}, nil
+}
+
+func (c *MemoryCache) Close() {
+
+}
+
+func (c *MemoryCache) Walk(prefix string, fn func(Entry) error) error {
+
+	// Copy the entries, so fn can delete them.
+	c.mutex.Lock()
+	var entries []Entry
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*memoryEntry)
+		if !strings.HasPrefix(entry.key, prefix) || expired(entry.expires) {
+			continue
+		}
+		entries = append(entries, Entry{Raw(entry.key), entry.version, int64(len(entry.value)), entry.expires})
+	}
+	c.mutex.Unlock()
+
+	for _, entry := range entries {
+		err := fn(entry)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+func (c *MemoryCache) Expires(key Key) (time.Time, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	e, ok := c.entries[key.String()]
+	if !ok {
+		return time.Time{}, nil
+	}
+	return e.Value.(*memoryEntry).expires, nil
+}
+
+func (c *MemoryCache) Delete(key Key) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.remove(key.String())
+	return nil
+}
+
+func (c *MemoryCache) DeletePrefix(prefix string) (int, error) {
+	return deletePrefix(c, prefix)
+}
+
+// get returns the value of an entry if it has the requested version, marking it as recently used.
+func (c *MemoryCache) get(key Key, version Version) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	e, ok := c.entries[key.String()]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*memoryEntry)
+	if expired(entry.expires) {
+		c.remove(entry.key)
+		return nil, false
+	}
+	if entry.version != version.String() {
+		return nil, false
+	}
+
+	c.lru.MoveToFront(e)
+	return entry.value, true
+}
+
+// remove deletes an entry, if it exists. The mutex must be held.
+func (c *MemoryCache) remove(key string) {
+	e, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	c.size -= e.Value.(*memoryEntry).size()
+	c.lru.Remove(e)
+	delete(c.entries, key)
+}
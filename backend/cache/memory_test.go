@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/fxkr/openview/backend/util/safe"
+)
+
+func TestMemoryCache(t *testing.T) {
+	_ = Suite(&MemoryCacheSuite{})
+	TestingT(t)
+}
+
+type MemoryCacheSuite struct {
+}
+
+func (s *MemoryCacheSuite) get(mc *MemoryCache, name string) string {
+	value, _ := mc.get(safe.NewKey(name), safe.NewKey("v1"))
+	return string(value)
+}
+
+func (s *MemoryCacheSuite) TestGetBytes(c *C) {
+	mc := NewMemoryCache(MemoryCacheConfig{})
+
+	for _, expected := range []string{"value", "value"} {
+		value, err := mc.GetBytes(safe.NewKey("a"), safe.NewKey("v1"), func() (Version, []byte, error) {
+			return safe.NewKey("v1"), []byte("value"), nil
+		})
+		c.Assert(err, IsNil)
+		c.Assert(string(value), Equals, expected)
+	}
+
+	value, err := mc.GetBytes(safe.NewKey("a"), safe.NewKey("v2"), func() (Version, []byte, error) {
+		return safe.NewKey("v2"), []byte("new value"), nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "new value")
+	c.Assert(mc.size, Equals, int64(len(safe.NewKey("a").String()+safe.NewKey("v2").String()+"new value")))
+}
+
+func (s *MemoryCacheSuite) TestGetHandler(c *C) {
+	mc := NewMemoryCache(MemoryCacheConfig{})
+
+	h, err := mc.GetHandler(safe.NewKey("a"), safe.NewKey("v1"), func() (Version, []byte, error) {
+		return safe.NewKey("v1"), []byte("value"), nil
+	}, "text/plain")
+	c.Assert(err, IsNil)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Header().Get("Content-Length"), Equals, "5")
+	c.Assert(w.Body.String(), Equals, "value")
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Range", "bytes=1-3")
+	h.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusPartialContent)
+	c.Assert(w.Body.String(), Equals, "alu")
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("HEAD", "/", nil))
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Header().Get("Content-Length"), Equals, "5")
+	c.Assert(w.Body.Len(), Equals, 0)
+}
+
+func (s *MemoryCacheSuite) TestEvictLeastRecentlyUsed(c *C) {
+	entrySize := int64(len(safe.NewKey("a").String()+safe.NewKey("v1").String()) + 10)
+	mc := NewMemoryCache(MemoryCacheConfig{MaxSize: 3 * entrySize})
+
+	for _, name := range []string{"a", "b", "c"} {
+		c.Assert(mc.Put(safe.NewKey(name), safe.NewKey("v1"), make([]byte, 10)), IsNil)
+	}
+	c.Assert(s.get(mc, "a"), Not(Equals), "")
+
+	c.Assert(mc.Put(safe.NewKey("d"), safe.NewKey("v1"), make([]byte, 10)), IsNil)
+
+	c.Assert(s.get(mc, "a"), Not(Equals), "")
+	c.Assert(s.get(mc, "b"), Equals, "")
+	c.Assert(s.get(mc, "c"), Not(Equals), "")
+	c.Assert(s.get(mc, "d"), Not(Equals), "")
+	c.Assert(mc.size, Equals, 3*entrySize)
+}
+
+func (s *MemoryCacheSuite) TestTooLarge(c *C) {
+	mc := NewMemoryCache(MemoryCacheConfig{MaxSize: 10})
+
+	c.Assert(mc.Put(safe.NewKey("a"), safe.NewKey("v1"), make([]byte, 100)), IsNil)
+	c.Assert(mc.lru.Len(), Equals, 0)
+}
+
+func (s *MemoryCacheSuite) TestTTL(c *C) {
+	mc := NewMemoryCache(MemoryCacheConfig{})
+
+	c.Assert(mc.PutTTL(safe.NewKey("a"), safe.NewKey("v1"), []byte("value"), time.Hour), IsNil)
+	c.Assert(mc.PutTTL(safe.NewKey("b"), safe.NewKey("v1"), []byte("value"), time.Millisecond), IsNil)
+	time.Sleep(10 * time.Millisecond)
+
+	c.Assert(s.get(mc, "a"), Equals, "value")
+	c.Assert(s.get(mc, "b"), Equals, "")
+	c.Assert(mc.entries, HasLen, 1)
+
+	expires, err := mc.Expires(safe.NewKey("a"))
+	c.Assert(err, IsNil)
+	c.Assert(expires.After(time.Now()), Equals, true)
+	expires, err = mc.Expires(safe.NewKey("b"))
+	c.Assert(err, IsNil)
+	c.Assert(expires.IsZero(), Equals, true)
+}
@@ -1,6 +1,8 @@
 package cache
 
 import (
+	"time"
+
 	"github.com/alicebob/miniredis"
 	"github.com/pkg/errors"
 
@@ -12,8 +14,14 @@ type MiniRedisCache struct {
 	*RedisCache
 
 	miniredis *miniredis.Miniredis
+
+	stop chan struct{}
+	done chan struct{}
 }
 
+// miniRedisTick is how often time is advanced for miniredis, which doesn't expire keys by itself.
+const miniRedisTick = 100 * time.Millisecond
+
 type MiniRedisCacheConfig struct {
 }
 
@@ -44,13 +52,39 @@ func NewMiniRedisCache(config MiniRedisCacheConfig) (*MiniRedisCache, error) {
 		return nil, errors.WithStack(err)
 	}
 
-	return &MiniRedisCache{
+	c := &MiniRedisCache{
 		RedisCache: rc,
 		miniredis:  s,
-	}, nil
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go c.runClock()
+
+	return c, nil
 }
 
 func (c *MiniRedisCache) Close() {
+	close(c.stop)
+	<-c.done
 	c.RedisCache.Close()
 	c.miniredis.Close()
 }
+
+// runClock advances the time of miniredis, so TTLs expire.
+func (c *MiniRedisCache) runClock() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(miniRedisTick)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			c.miniredis.FastForward(now.Sub(last))
+			last = now
+		case <-c.stop:
+			return
+		}
+	}
+}
@@ -7,14 +7,21 @@ import (
 	"net/http"
 
 	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
 
 	"github.com/fxkr/openview/backend/util/handler"
 	"github.com/fxkr/openview/backend/util/safe"
 )
 
 // RedisCache is Cache implementation that stores keys on a Redis server.
+//
+// Connections are pooled, so it's safe for concurrent use.
 type RedisCache struct {
-	db     redis.Conn
+	pool   *redis.Pool
 	config RedisCacheConfig
 }
 
@@ -23,39 +30,128 @@ type RedisCacheConfig struct {
 	Network  string  `json:"network"`
 	Password *string `json:"password"`
 	Prefix   string  `json:"prefix"`
+
+	// Database is the number of the database to SELECT.
+	Database int `json:"database"`
+
+	// TLS enables TLS. TLSSkipVerify disables certificate verification, for self-signed certificates.
+	TLS           bool `json:"tls"`
+	TLSSkipVerify bool `json:"tls_skip_verify"`
+
+	// Timeouts of connecting and of reading and writing commands. Zero means no timeout.
+	ConnectTimeout time.Duration `json:"connect_timeout"`
+	ReadTimeout    time.Duration `json:"read_timeout"`
+	WriteTimeout   time.Duration `json:"write_timeout"`
+
+	// MaxIdle is the largest number of idle connections kept open. Zero means 2.
+	MaxIdle int `json:"max_idle"`
+
+	// MaxActive is the largest number of open connections. Zero means no limit.
+	// Once reached, commands wait for a connection to become available.
+	MaxActive int `json:"max_active"`
+
+	// IdleTimeout is how long idle connections are kept open. Zero means forever.
+	IdleTimeout time.Duration `json:"idle_timeout"`
+
+	// HealthCheckInterval is how long a connection may be idle before it's checked with a PING before use.
+	// Zero means connections are always checked.
+	HealthCheckInterval time.Duration `json:"health_check_interval"`
 }
 
 // Statically assert that *RedisCache implements Cache.
 var _ Cache = (*RedisCache)(nil)
 
 func NewRedisCache(config RedisCacheConfig) (*RedisCache, error) {
-	c, err := redis.Dial(config.Network, config.Host)
-	if err != nil {
-		return nil, errors.WithStack(err)
+	options := []redis.DialOption{
+		redis.DialDatabase(config.Database),
+		redis.DialConnectTimeout(config.ConnectTimeout),
+		redis.DialReadTimeout(config.ReadTimeout),
+		redis.DialWriteTimeout(config.WriteTimeout),
+		redis.DialUseTLS(config.TLS),
+		redis.DialTLSSkipVerify(config.TLSSkipVerify),
 	}
-
 	if config.Password != nil {
-		_, err = redis.String(c.Do("AUTH", *config.Password))
-		if err != nil {
-			return nil, errors.WithStack(err)
-		}
+		options = append(options, redis.DialPassword(*config.Password))
+	}
+
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial(config.Network, config.Host, options...)
+		},
+		TestOnBorrow: func(conn redis.Conn, lastUsed time.Time) error {
+			if time.Since(lastUsed) < config.HealthCheckInterval {
+				return nil
+			}
+			_, err := conn.Do("PING")
+			return err
+		},
+		MaxIdle:     config.MaxIdle,
+		MaxActive:   config.MaxActive,
+		IdleTimeout: config.IdleTimeout,
+		Wait:        config.MaxActive > 0,
+	}
+	if pool.MaxIdle == 0 {
+		pool.MaxIdle = 2
+	}
+
+	// Fail early if the server is unreachable or the configuration is wrong.
+	conn := pool.Get()
+	_, err := conn.Do("PING")
+	conn.Close()
+	if err != nil {
+		pool.Close()
+		return nil, errors.WithStack(err)
 	}
 
 	return &RedisCache{
-		db:     c,
+		pool:   pool,
 		config: config,
 	}, nil
 }
 
+// Close closes all connections.
 func (c *RedisCache) Close() {
-	c.Close()
+	c.pool.Close()
 }
 
 func (c *RedisCache) Put(key Key, version Version, value []byte) error {
+	return c.PutTTL(key, version, value, 0)
+}
+
+// PutTTL lets Redis expire the value and version together.
+func (c *RedisCache) PutTTL(key Key, version Version, value []byte, ttl time.Duration) error {
 	dataKey := c.config.Prefix + key.String()
 	versionKey := c.config.Prefix + safe.NewKey(key.String(), "ver").String()
 
-	_, err := c.db.Do("MSET", dataKey, value, versionKey, []byte(version.String()))
+	if ttl == 0 {
+		_, err := c.do("MSET", dataKey, value, versionKey, []byte(version.String()))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return nil
+	}
+
+	// Redis rounds down, and would reject a TTL of zero.
+	ms := int64(ttl / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+
+	conn := c.pool.Get()
+	defer conn.Close()
+	err := conn.Send("MULTI")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = conn.Send("SET", dataKey, value, "PX", ms)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = conn.Send("SET", versionKey, []byte(version.String()), "PX", ms)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = conn.Do("EXEC")
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -67,7 +163,7 @@ func (c *RedisCache) GetBytes(key Key, version Version, filler func() (Version,
 	dataKey := c.config.Prefix + key.String()
 	versionKey := c.config.Prefix + safe.NewKey(key.String(), "ver").String()
 
-	values, err := redis.ByteSlices(c.db.Do("MGET", versionKey, dataKey))
+	values, err := redis.ByteSlices(c.do("MGET", versionKey, dataKey))
 	if err == nil && len(values) == 2 { // Cache hit?
 		if bytes.Equal(values[0], []byte(version.String())) { // Cache up to date?
 			cachedBytes := values[1]
@@ -97,5 +193,188 @@ func (c *RedisCache) GetHandler(key Key, version Version, filler func() (Version
 	return &handler.ByteHandler{
 		Bytes:       bytes,
 		ContentType: contentType,
+		Validators:  validators(version),
 	}, nil
 }
+
+func (c *RedisCache) PutStream(key Key, version Version, r io.Reader, ttl time.Duration) error {
+	value, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return c.PutTTL(key, version, value, ttl)
+}
+
+// GetStream buffers the value, since it's read in one piece anyway.
+func (c *RedisCache) GetStream(key Key, version Version, filler StreamFiller) (io.ReadCloser, error) {
+	value, err := c.GetBytes(key, version, buffered(filler))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return ioutil.NopCloser(bytes.NewReader(value)), nil
+}
+
+func (c *RedisCache) GetStreamHandler(key Key, version Version, filler StreamFiller, contentType string) (http.Handler, error) {
+	value, err := c.GetBytes(key, version, buffered(filler))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &handler.ReaderHandler{Reader: bytes.NewReader(value), ContentType: contentType, Validators: validators(version)}, nil
+}
+
+// Walk uses SCAN, so the prefix is matched by the server.
+func (c *RedisCache) Walk(prefix string, fn func(Entry) error) error {
+	cursor := "0"
+	for {
+		var entries []Entry
+		var err error
+		cursor, entries, err = c.scan(cursor, prefix)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		for _, entry := range entries {
+			err = fn(entry)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// scan runs one SCAN step and reads the metadata of the values it returns, pipelined in one round trip.
+// It returns the next cursor.
+func (c *RedisCache) scan(cursor string, prefix string) (string, []Entry, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", escapePattern(c.config.Prefix+prefix)+"*"))
+	if err != nil {
+		return "", nil, errors.WithStack(err)
+	}
+	var dataKeys []string
+	_, err = redis.Scan(values, &cursor, &dataKeys)
+	if err != nil {
+		return "", nil, errors.WithStack(err)
+	}
+
+	var keys []string
+	for _, dataKey := range dataKeys {
+		key := strings.TrimPrefix(dataKey, c.config.Prefix)
+		if isVersionKey(key) {
+			continue
+		}
+		versionKey := c.config.Prefix + safe.NewKey(key, "ver").String()
+
+		err = conn.Send("GET", versionKey)
+		if err != nil {
+			return "", nil, errors.WithStack(err)
+		}
+		err = conn.Send("STRLEN", dataKey)
+		if err != nil {
+			return "", nil, errors.WithStack(err)
+		}
+		err = conn.Send("PTTL", dataKey)
+		if err != nil {
+			return "", nil, errors.WithStack(err)
+		}
+		keys = append(keys, key)
+	}
+	err = conn.Flush()
+	if err != nil {
+		return "", nil, errors.WithStack(err)
+	}
+
+	var entries []Entry
+	for _, key := range keys {
+		// All replies are received before checking them, so the connection stays in sync.
+		version, versionErr := redis.Bytes(conn.Receive())
+		size, sizeErr := redis.Int64(conn.Receive())
+		ttl, ttlErr := redis.Int64(conn.Receive())
+		if versionErr == redis.ErrNil {
+			continue // Deleted since
+		} else if versionErr != nil {
+			return "", nil, errors.WithStack(versionErr)
+		}
+		if sizeErr != nil {
+			return "", nil, errors.WithStack(sizeErr)
+		}
+		if ttlErr != nil {
+			return "", nil, errors.WithStack(ttlErr)
+		}
+
+		var expires time.Time
+		if ttl > 0 {
+			expires = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		}
+		entries = append(entries, Entry{
+			Key:     Raw(key),
+			Version: string(version),
+			Size:    size,
+			Expires: expires,
+		})
+	}
+
+	return cursor, entries, nil
+}
+
+func (c *RedisCache) Expires(key Key) (time.Time, error) {
+	ttl, err := redis.Int64(c.do("PTTL", c.config.Prefix+key.String()))
+	if err != nil {
+		return time.Time{}, errors.WithStack(err)
+	}
+
+	// Negative for missing values and values without expiry.
+	if ttl <= 0 {
+		return time.Time{}, nil
+	}
+	return time.Now().Add(time.Duration(ttl) * time.Millisecond), nil
+}
+
+func (c *RedisCache) Delete(key Key) error {
+	dataKey := c.config.Prefix + key.String()
+	versionKey := c.config.Prefix + safe.NewKey(key.String(), "ver").String()
+
+	_, err := c.do("DEL", dataKey, versionKey)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+func (c *RedisCache) DeletePrefix(prefix string) (int, error) {
+	return deletePrefix(c, prefix)
+}
+
+// do runs a command on a pooled connection.
+func (c *RedisCache) do(command string, args ...interface{}) (interface{}, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	return conn.Do(command, args...)
+}
+
+// isVersionKey returns true for the keys versions are stored under, rather than values.
+//
+// Those are keys of the form [key, "ver"]. Keys of values never start with another key.
+func isVersionKey(key string) bool {
+	var components []string
+	err := json.Unmarshal([]byte(key), &components)
+	return err == nil && len(components) == 2 && components[1] == "ver" && strings.HasPrefix(components[0], "[")
+}
+
+// escapePattern escapes the special characters of Redis glob-style patterns.
+func escapePattern(s string) string {
+	var b bytes.Buffer
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]^\`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,184 @@
+package cache
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+
+	"github.com/fxkr/openview/backend/util/safe"
+)
+
+func TestRedisCache(t *testing.T) {
+	_ = Suite(&RedisCacheSuite{})
+	TestingT(t)
+}
+
+type RedisCacheSuite struct {
+	server *miniredis.Miniredis
+	config RedisCacheConfig
+}
+
+func (s *RedisCacheSuite) SetUpTest(c *C) {
+	var err error
+	s.server, err = miniredis.Run()
+	c.Assert(err, IsNil)
+	s.server.RequireAuth("secret")
+
+	password := "secret"
+	s.config = RedisCacheConfig{
+		Network:  "tcp",
+		Host:     s.server.Addr(),
+		Password: &password,
+		Prefix:   "test:",
+		Database: 2,
+	}
+}
+
+func (s *RedisCacheSuite) TearDownTest(c *C) {
+	s.server.Close()
+}
+
+func (s *RedisCacheSuite) TestGetBytes(c *C) {
+	rc, err := NewRedisCache(s.config)
+	c.Assert(err, IsNil)
+	defer rc.Close()
+
+	for i := 0; i < 2; i++ {
+		value, err := rc.GetBytes(safe.NewKey("a"), safe.NewKey("v1"), func() (Version, []byte, error) {
+			c.Assert(i, Equals, 0, Commentf("Unexpected cache miss"))
+			return safe.NewKey("v1"), []byte("value"), nil
+		})
+		c.Assert(err, IsNil)
+		c.Assert(string(value), Equals, "value")
+	}
+
+	c.Assert(s.server.DB(2).Keys(), HasLen, 2)
+	c.Assert(s.server.DB(0).Keys(), HasLen, 0)
+}
+
+func (s *RedisCacheSuite) TestConcurrent(c *C) {
+	rc, err := NewRedisCache(s.config)
+	c.Assert(err, IsNil)
+	defer rc.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := safe.NewKey("key", i%5)
+			value, err := rc.GetBytes(key, safe.NewKey("v1"), func() (Version, []byte, error) {
+				return safe.NewKey("v1"), []byte(key.String()), nil
+			})
+			if err == nil && string(value) != key.String() {
+				err = errors.Errorf("Wrong value: %s", value)
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *RedisCacheSuite) TestWalk(c *C) {
+	rc, err := NewRedisCache(s.config)
+	c.Assert(err, IsNil)
+	defer rc.Close()
+
+	c.Assert(rc.Put(safe.NewKey("a"), safe.NewKey("v1"), []byte("value")), IsNil)
+	c.Assert(rc.Put(safe.NewKey("b"), safe.NewKey("v2"), []byte("other value")), IsNil)
+
+	entries := map[string]Entry{}
+	c.Assert(rc.Walk("", func(entry Entry) error {
+		entries[entry.Key.String()] = entry
+		return rc.Delete(entry.Key)
+	}), IsNil)
+
+	c.Assert(entries, DeepEquals, map[string]Entry{
+		safe.NewKey("a").String(): {Raw(safe.NewKey("a").String()), safe.NewKey("v1").String(), 5, time.Time{}},
+		safe.NewKey("b").String(): {Raw(safe.NewKey("b").String()), safe.NewKey("v2").String(), 11, time.Time{}},
+	})
+	c.Assert(s.server.DB(2).Keys(), HasLen, 0)
+}
+
+func (s *RedisCacheSuite) TestTTL(c *C) {
+	rc, err := NewRedisCache(s.config)
+	c.Assert(err, IsNil)
+	defer rc.Close()
+
+	c.Assert(rc.PutTTL(safe.NewKey("a"), safe.NewKey("v1"), []byte("value"), time.Minute), IsNil)
+
+	var entries []Entry
+	c.Assert(rc.Walk("", func(entry Entry) error {
+		entries = append(entries, entry)
+		return nil
+	}), IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Assert(entries[0].Expires.After(time.Now()), Equals, true)
+
+	expires, err := rc.Expires(safe.NewKey("a"))
+	c.Assert(err, IsNil)
+	c.Assert(expires.After(time.Now()), Equals, true)
+
+	s.server.FastForward(time.Minute)
+	c.Assert(s.server.DB(2).Keys(), HasLen, 0)
+}
+
+func (s *RedisCacheSuite) TestMiniRedisTTL(c *C) {
+	mc, err := NewMiniRedisCache(MiniRedisCacheConfig{})
+	c.Assert(err, IsNil)
+	defer mc.Close()
+
+	c.Assert(mc.PutTTL(safe.NewKey("a"), safe.NewKey("v1"), []byte("value"), 50*time.Millisecond), IsNil)
+	time.Sleep(5 * miniRedisTick)
+
+	value, err := mc.GetBytes(safe.NewKey("a"), safe.NewKey("v1"), func() (Version, []byte, error) {
+		return safe.NewKey("v1"), []byte("new value"), nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "new value")
+}
+
+func (s *RedisCacheSuite) TestDeletePrefix(c *C) {
+	rc, err := NewRedisCache(s.config)
+	c.Assert(err, IsNil)
+	defer rc.Close()
+
+	c.Assert(rc.Put(safe.NewKey("thumbnail", "album/a.jpg", "800"), safe.NewKey("v1"), []byte("value")), IsNil)
+	c.Assert(rc.Put(safe.NewKey("thumbnail", "other/a.jpg", "800"), safe.NewKey("v1"), []byte("value")), IsNil)
+
+	deleted, err := rc.DeletePrefix(safe.NewKeyPrefix("thumbnail", "album/"))
+	c.Assert(err, IsNil)
+	c.Assert(deleted, Equals, 1)
+	c.Assert(s.server.DB(2).Keys(), HasLen, 2) // Value and version of the other thumbnail
+}
+
+func (s *RedisCacheSuite) TestReconnect(c *C) {
+	rc, err := NewRedisCache(s.config)
+	c.Assert(err, IsNil)
+	defer rc.Close()
+
+	c.Assert(rc.Put(safe.NewKey("a"), safe.NewKey("v1"), []byte("value")), IsNil)
+
+	// The idle connection breaks. The health check replaces it.
+	s.server.Restart()
+
+	c.Assert(rc.Put(safe.NewKey("a"), safe.NewKey("v1"), []byte("value")), IsNil)
+}
+
+func (s *RedisCacheSuite) TestWrongPassword(c *C) {
+	password := "wrong"
+	s.config.Password = &password
+
+	_, err := NewRedisCache(s.config)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,378 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/fxkr/openview/backend/util/handler"
+)
+
+// TieredCache is Cache implementation that stacks caches, typically faster and smaller ones in front of larger ones.
+//
+// Lookups go through the tiers in order, checking the version at each. A value found in a lower tier
+// is promoted to all tiers above it. Puts write through to all tiers.
+//
+// Promoted values keep the expiry they have in the tier they were found in.
+//
+// Streamed values are served from the bottom tier without buffering them in the tiers above,
+// and only promoted if they are at most MaxPromoteSize.
+type TieredCache struct {
+	config TieredCacheConfig
+	tiers  []Cache
+}
+
+type TieredCacheConfig struct {
+
+	// MaxPromoteSize is the largest size of streamed values that are promoted, in bytes. Zero means no limit.
+	MaxPromoteSize int64 `json:"max_promote_size"`
+}
+
+// Statically assert that *TieredCache implements Cache.
+var _ Cache = (*TieredCache)(nil)
+
+// NewTieredCache stacks caches, the first one on top.
+func NewTieredCache(config TieredCacheConfig, tiers ...Cache) (*TieredCache, error) {
+	if len(tiers) == 0 {
+		return nil, errors.New("Tiered cache needs at least one tier")
+	}
+	return &TieredCache{config, tiers}, nil
+}
+
+func (c *TieredCache) Put(key Key, version Version, value []byte) error {
+	return c.PutTTL(key, version, value, 0)
+}
+
+func (c *TieredCache) PutTTL(key Key, version Version, value []byte, ttl time.Duration) error {
+	for _, tier := range c.tiers {
+		err := tier.PutTTL(key, version, value, ttl)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func (c *TieredCache) GetBytes(key Key, version Version, filler func() (Version, []byte, error)) ([]byte, error) {
+	value, _, err := c.getBytes(key, version, filler, 0)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return value, nil
+}
+
+func (c *TieredCache) GetHandler(key Key, version Version, filler func() (Version, []byte, error), contentType string) (http.Handler, error) {
+	if len(c.tiers) == 1 {
+		return c.tiers[0].GetHandler(key, version, filler, contentType)
+	}
+
+	h, err := c.tiers[0].GetHandler(key, version, missingBytes, contentType)
+	if errors.Cause(err) != errTierMiss {
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return h, nil
+	}
+
+	value, filledVersion, err := c.getBytes(key, version, filler, 1)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &handler.ByteHandler{Bytes: value, ContentType: contentType, Validators: validators(filledVersion)}, nil
+}
+
+// getBytes looks a value up in the tiers starting at index from, filling the bottom tier if necessary,
+// and promotes it to all tiers above the one it was found in.
+//
+// It returns the value with the version it was found or filled with.
+func (c *TieredCache) getBytes(key Key, version Version, filler func() (Version, []byte, error), from int) ([]byte, Version, error) {
+	bottom := len(c.tiers) - 1
+	for i := from; i < bottom; i++ {
+		value, err := c.tiers[i].GetBytes(key, version, missingBytes)
+		if errors.Cause(err) == errTierMiss {
+			continue
+		} else if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+
+		err = c.promote(key, version, value, c.tiers[i], c.tiers[:i])
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		return value, version, nil
+	}
+
+	source := c.tiers[bottom]
+	filledVersion := version
+	value, err := c.tiers[bottom].GetBytes(key, version, func() (Version, []byte, error) {
+		v, value, err := filler()
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		source = nil
+		filledVersion = v
+		return v, value, nil
+	})
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	err = c.promote(key, filledVersion, value, source, c.tiers[:bottom])
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	return value, filledVersion, nil
+}
+
+// PutStream streams the value to the bottom tier only, and deletes it from the tiers above,
+// so it's promoted when it's next read.
+func (c *TieredCache) PutStream(key Key, version Version, r io.Reader, ttl time.Duration) error {
+	for _, tier := range c.tiers[:len(c.tiers)-1] {
+		err := tier.Delete(key)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	err := c.tiers[len(c.tiers)-1].PutStream(key, version, r, ttl)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (c *TieredCache) GetStream(key Key, version Version, filler StreamFiller) (io.ReadCloser, error) {
+	if len(c.tiers) == 1 {
+		return c.tiers[0].GetStream(key, version, filler)
+	}
+
+	bottom := len(c.tiers) - 1
+	for i, tier := range c.tiers[:bottom] {
+		r, err := tier.GetStream(key, version, missing)
+		if errors.Cause(err) == errTierMiss {
+			continue
+		} else if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if i == 0 {
+			return r, nil
+		}
+
+		r, _, err = c.promoteStream(key, version, r, tier, c.tiers[:i])
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return r, nil
+	}
+
+	r, filledVersion, source, err := c.getBottomStream(key, version, filler)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	r, _, err = c.promoteStream(key, filledVersion, r, source, c.tiers[:bottom])
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return r, nil
+}
+
+func (c *TieredCache) GetStreamHandler(key Key, version Version, filler StreamFiller, contentType string) (http.Handler, error) {
+	if len(c.tiers) == 1 {
+		return c.tiers[0].GetStreamHandler(key, version, filler, contentType)
+	}
+
+	h, err := c.tiers[0].GetStreamHandler(key, version, missing, contentType)
+	if errors.Cause(err) != errTierMiss {
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return h, nil
+	}
+
+	bottom := len(c.tiers) - 1
+	for i := 1; i < bottom; i++ {
+		tier := c.tiers[i]
+		r, err := tier.GetStream(key, version, missing)
+		if errors.Cause(err) == errTierMiss {
+			continue
+		} else if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		r, value, err := c.promoteStream(key, version, r, tier, c.tiers[:i])
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if value != nil {
+			return &handler.ByteHandler{Bytes: value, ContentType: contentType, Validators: validators(version)}, nil
+		}
+
+		// Too large to promote. Opened again by the tier, so it can serve ranges, unless it was evicted since.
+		r.Close()
+		h, err := tier.GetStreamHandler(key, version, missing, contentType)
+		if errors.Cause(err) == errTierMiss {
+			continue
+		} else if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return h, nil
+	}
+
+	r, filledVersion, source, err := c.getBottomStream(key, version, filler)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	r, value, err := c.promoteStream(key, filledVersion, r, source, c.tiers[:bottom])
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if value != nil {
+		return &handler.ByteHandler{Bytes: value, ContentType: contentType, Validators: validators(filledVersion)}, nil
+	}
+
+	// Opened again by the bottom tier, so it can serve ranges. The value is there now, so this is a hit.
+	r.Close()
+	return c.tiers[bottom].GetStreamHandler(key, version, filler, contentType)
+}
+
+// errTierMiss is returned by the fillers of tiers above the bottom one, so values aren't filled there.
+var errTierMiss = errors.New("Not in this tier")
+
+func missing(w io.Writer) (Version, error) {
+	return nil, errTierMiss
+}
+
+func missingBytes() (Version, []byte, error) {
+	return nil, nil, errTierMiss
+}
+
+// getBottomStream gets a value from the bottom tier, filling it if necessary.
+//
+// It returns a stream of the value with the version it was found or filled with, and the bottom tier
+// if it was found there, to look up its expiry, or nil if it was filled.
+func (c *TieredCache) getBottomStream(key Key, version Version, filler StreamFiller) (io.ReadCloser, Version, Cache, error) {
+	bottom := c.tiers[len(c.tiers)-1]
+	source := bottom
+	filledVersion := version
+	r, err := bottom.GetStream(key, version, func(w io.Writer) (Version, error) {
+		v, err := filler(w)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		source = nil
+		filledVersion = v
+		return v, nil
+	})
+	if err != nil {
+		return nil, nil, nil, errors.WithStack(err)
+	}
+	return r, filledVersion, source, nil
+}
+
+// promoteStream promotes a streamed value to tiers if it is at most MaxPromoteSize, see promote.
+//
+// Promoted values are read into memory and returned along with a stream of them, and r is closed.
+// Otherwise, a stream continuing r is returned without a value.
+func (c *TieredCache) promoteStream(key Key, version Version, r io.ReadCloser, source Cache, tiers []Cache) (io.ReadCloser, []byte, error) {
+	limited := r
+	if c.config.MaxPromoteSize > 0 {
+		limited = ioutil.NopCloser(io.LimitReader(r, c.config.MaxPromoteSize+1))
+	}
+	value, err := ioutil.ReadAll(limited)
+	if err != nil {
+		r.Close()
+		return nil, nil, errors.WithStack(err)
+	}
+	if c.config.MaxPromoteSize > 0 && int64(len(value)) > c.config.MaxPromoteSize {
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(value), r), r}, nil, nil
+	}
+	r.Close()
+
+	err = c.promote(key, version, value, source, tiers)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	return ioutil.NopCloser(bytes.NewReader(value)), value, nil
+}
+
+// promote puts a value found in source into tiers, keeping the expiry it has there.
+// Values that were just filled have no source, and don't expire.
+func (c *TieredCache) promote(key Key, version Version, value []byte, source Cache, tiers []Cache) error {
+	if len(tiers) == 0 {
+		return nil
+	}
+
+	var ttl time.Duration
+	if source != nil {
+		expires, err := source.Expires(key)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if !expires.IsZero() {
+			ttl = time.Until(expires)
+			if ttl <= 0 {
+				return nil // Expired since it was read
+			}
+		}
+	}
+
+	for _, tier := range tiers {
+		err := tier.PutTTL(key, version, value, ttl)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func (c *TieredCache) Close() {
+	for _, tier := range c.tiers {
+		tier.Close()
+	}
+}
+
+// Expires returns the expiry in the bottom tier, which all values are written through or streamed to.
+func (c *TieredCache) Expires(key Key) (time.Time, error) {
+	return c.tiers[len(c.tiers)-1].Expires(key)
+}
+
+// Walk visits values once, with the metadata of the highest tier that has them.
+func (c *TieredCache) Walk(prefix string, fn func(Entry) error) error {
+	seen := make(map[string]bool)
+	for _, tier := range c.tiers {
+		err := tier.Walk(prefix, func(entry Entry) error {
+			if seen[entry.Key.String()] {
+				return nil
+			}
+			seen[entry.Key.String()] = true
+			return fn(entry)
+		})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// Delete removes a value from all tiers.
+func (c *TieredCache) Delete(key Key) error {
+	for _, tier := range c.tiers {
+		err := tier.Delete(key)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// DeletePrefix removes values from all tiers, and returns how many distinct keys were removed.
+func (c *TieredCache) DeletePrefix(prefix string) (int, error) {
+	return deletePrefix(c, prefix)
+}
@@ -0,0 +1,203 @@
+package cache
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+
+	"github.com/fxkr/openview/backend/util/safe"
+)
+
+func TestTieredCache(t *testing.T) {
+	_ = Suite(&TieredCacheSuite{})
+	TestingT(t)
+}
+
+type TieredCacheSuite struct {
+	top    *MemoryCache
+	bottom *MemoryCache
+	cache  *TieredCache
+}
+
+func (s *TieredCacheSuite) SetUpTest(c *C) {
+	s.top = NewMemoryCache(MemoryCacheConfig{})
+	s.bottom = NewMemoryCache(MemoryCacheConfig{})
+
+	var err error
+	s.cache, err = NewTieredCache(TieredCacheConfig{MaxPromoteSize: 8}, s.top, s.bottom)
+	c.Assert(err, IsNil)
+}
+
+func (s *TieredCacheSuite) getBytes(c *C, version string, fill string) string {
+	value, err := s.cache.GetBytes(safe.NewKey("a"), safe.NewKey(version), func() (Version, []byte, error) {
+		c.Assert(fill, Not(Equals), "", Commentf("Unexpected cache miss"))
+		return safe.NewKey(version), []byte(fill), nil
+	})
+	c.Assert(err, IsNil)
+	return string(value)
+}
+
+func (s *TieredCacheSuite) TestWriteThrough(c *C) {
+	c.Assert(s.getBytes(c, "v1", "value"), Equals, "value")
+
+	for _, tier := range []*MemoryCache{s.top, s.bottom} {
+		value, ok := tier.get(safe.NewKey("a"), safe.NewKey("v1"))
+		c.Assert(ok, Equals, true)
+		c.Assert(string(value), Equals, "value")
+	}
+}
+
+func (s *TieredCacheSuite) TestPromote(c *C) {
+	c.Assert(s.bottom.Put(safe.NewKey("a"), safe.NewKey("v1"), []byte("value")), IsNil)
+
+	c.Assert(s.getBytes(c, "v1", ""), Equals, "value")
+
+	value, ok := s.top.get(safe.NewKey("a"), safe.NewKey("v1"))
+	c.Assert(ok, Equals, true)
+	c.Assert(string(value), Equals, "value")
+}
+
+func (s *TieredCacheSuite) TestVersionPerTier(c *C) {
+	c.Assert(s.top.Put(safe.NewKey("a"), safe.NewKey("v1"), []byte("old value")), IsNil)
+	c.Assert(s.bottom.Put(safe.NewKey("a"), safe.NewKey("v2"), []byte("value")), IsNil)
+
+	c.Assert(s.getBytes(c, "v2", ""), Equals, "value")
+	c.Assert(s.getBytes(c, "v3", "new value"), Equals, "new value")
+
+	value, ok := s.bottom.get(safe.NewKey("a"), safe.NewKey("v3"))
+	c.Assert(ok, Equals, true)
+	c.Assert(string(value), Equals, "new value")
+}
+
+func (s *TieredCacheSuite) TestStream(c *C) {
+	c.Assert(s.bottom.Put(safe.NewKey("a"), safe.NewKey("v1"), []byte("value")), IsNil)
+
+	r, err := s.cache.GetStream(safe.NewKey("a"), safe.NewKey("v1"), func(w io.Writer) (Version, error) {
+		return nil, errors.New("Unexpected cache miss")
+	})
+	c.Assert(err, IsNil)
+	value, err := ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	c.Assert(r.Close(), IsNil)
+	c.Assert(string(value), Equals, "value")
+
+	c.Assert(s.cache.PutStream(safe.NewKey("a"), safe.NewKey("v2"), strings.NewReader("new value"), 0), IsNil)
+	_, ok := s.top.get(safe.NewKey("a"), safe.NewKey("v1"))
+	c.Assert(ok, Equals, false)
+	c.Assert(s.getBytes(c, "v2", ""), Equals, "new value")
+}
+
+func (s *TieredCacheSuite) TestStreamHandlerPromoteSize(c *C) {
+	values := map[string]string{"small": "value", "large": "large value"}
+	for key, value := range values {
+		c.Assert(s.bottom.Put(safe.NewKey(key), safe.NewKey("v1"), []byte(value)), IsNil)
+	}
+
+	for key, value := range values {
+		h, err := s.cache.GetStreamHandler(safe.NewKey(key), safe.NewKey("v1"), func(w io.Writer) (Version, error) {
+			return nil, errors.New("Unexpected cache miss")
+		}, "text/plain")
+		c.Assert(err, IsNil)
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		c.Assert(w.Code, Equals, http.StatusOK)
+		c.Assert(w.Body.String(), Equals, value)
+	}
+
+	_, ok := s.top.get(safe.NewKey("small"), safe.NewKey("v1"))
+	c.Assert(ok, Equals, true)
+	_, ok = s.top.get(safe.NewKey("large"), safe.NewKey("v1"))
+	c.Assert(ok, Equals, false)
+}
+
+func (s *TieredCacheSuite) TestStreamFill(c *C) {
+	h, err := s.cache.GetStreamHandler(safe.NewKey("a"), safe.NewKey("v1"), func(w io.Writer) (Version, error) {
+		_, err := io.WriteString(w, "large value")
+		return safe.NewKey("v1"), err
+	}, "text/plain")
+	c.Assert(err, IsNil)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	c.Assert(w.Body.String(), Equals, "large value")
+
+	_, ok := s.top.get(safe.NewKey("a"), safe.NewKey("v1"))
+	c.Assert(ok, Equals, false)
+	value, ok := s.bottom.get(safe.NewKey("a"), safe.NewKey("v1"))
+	c.Assert(ok, Equals, true)
+	c.Assert(string(value), Equals, "large value")
+}
+
+func (s *TieredCacheSuite) TestStreamPromoteMiddle(c *C) {
+	middle := NewMemoryCache(MemoryCacheConfig{})
+	tiered, err := NewTieredCache(TieredCacheConfig{MaxPromoteSize: 8}, s.top, middle, s.bottom)
+	c.Assert(err, IsNil)
+
+	values := map[string]string{"a": "value", "b": "value", "large": "large value"}
+	for key, value := range values {
+		c.Assert(middle.Put(safe.NewKey(key), safe.NewKey("v1"), []byte(value)), IsNil)
+	}
+	fail := func(w io.Writer) (Version, error) {
+		return nil, errors.New("Unexpected cache miss")
+	}
+
+	r, err := tiered.GetStream(safe.NewKey("a"), safe.NewKey("v1"), fail)
+	c.Assert(err, IsNil)
+	value, err := ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	c.Assert(r.Close(), IsNil)
+	c.Assert(string(value), Equals, "value")
+
+	for _, key := range []string{"b", "large"} {
+		h, err := tiered.GetStreamHandler(safe.NewKey(key), safe.NewKey("v1"), fail, "text/plain")
+		c.Assert(err, IsNil)
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		c.Assert(w.Code, Equals, http.StatusOK)
+		c.Assert(w.Body.String(), Equals, values[key])
+	}
+
+	for _, key := range []string{"a", "b"} {
+		_, ok := s.top.get(safe.NewKey(key), safe.NewKey("v1"))
+		c.Assert(ok, Equals, true, Commentf("%v wasn't promoted", key))
+	}
+	_, ok := s.top.get(safe.NewKey("large"), safe.NewKey("v1"))
+	c.Assert(ok, Equals, false)
+	_, ok = s.bottom.get(safe.NewKey("a"), safe.NewKey("v1"))
+	c.Assert(ok, Equals, false)
+}
+
+func (s *TieredCacheSuite) TestPromoteTTL(c *C) {
+	c.Assert(s.bottom.PutTTL(safe.NewKey("a"), safe.NewKey("v1"), []byte("value"), time.Hour), IsNil)
+	c.Assert(s.bottom.PutTTL(safe.NewKey("b"), safe.NewKey("v1"), []byte("value"), time.Hour), IsNil)
+
+	c.Assert(s.getBytes(c, "v1", ""), Equals, "value")
+	r, err := s.cache.GetStream(safe.NewKey("b"), safe.NewKey("v1"), func(w io.Writer) (Version, error) {
+		return nil, errors.New("Unexpected cache miss")
+	})
+	c.Assert(err, IsNil)
+	c.Assert(r.Close(), IsNil)
+
+	for _, key := range []string{"a", "b"} {
+		expires, err := s.top.Expires(safe.NewKey(key))
+		c.Assert(err, IsNil)
+		c.Assert(expires.IsZero(), Equals, false, Commentf("%v was promoted without expiry", key))
+		c.Assert(expires.After(time.Now().Add(time.Hour)), Equals, false)
+	}
+
+	// Filled values don't expire.
+	c.Assert(s.cache.Delete(safe.NewKey("a")), IsNil)
+	c.Assert(s.getBytes(c, "v1", "value"), Equals, "value")
+	expires, err := s.top.Expires(safe.NewKey("a"))
+	c.Assert(err, IsNil)
+	c.Assert(expires.IsZero(), Equals, true)
+}
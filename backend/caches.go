@@ -0,0 +1,80 @@
+package backend
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/fxkr/openview/backend/cache"
+)
+
+// Cache implementations for Config.ThumbnailCache and Config.MetadataCache.
+const (
+	CacheFile   = "file"
+	CacheMemory = "memory"
+	CacheBolt   = "bolt"
+	CacheRedis  = "redis"
+)
+
+// boltCacheFile is the name of the database of the bolt metadata cache in the CacheDir.
+const boltCacheFile = "metadata.db"
+
+// newThumbnailCache creates the thumbnail cache selected in the config, with a memory tier in front if enabled.
+func newThumbnailCache(config *Config) (cache.Cache, error) {
+	var result cache.Cache
+	switch config.ThumbnailCache {
+	case "", CacheFile:
+		fc, err := cache.NewFileCache(config.CacheDir, config.FileCache)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		result = fc
+	case CacheRedis:
+		rc, err := newRedisCache(config, "thumbnail:")
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		result = rc
+	default:
+		return nil, errors.Errorf("Bad thumbnail cache: %v", config.ThumbnailCache)
+	}
+
+	// Hot thumbnails are served from memory, if there's a memory tier.
+	if config.ThumbnailMemoryCache.MaxSize > 0 {
+		tc, err := cache.NewTieredCache(config.ThumbnailTieredCache, cache.NewMemoryCache(config.ThumbnailMemoryCache), result)
+		if err != nil {
+			result.Close()
+			return nil, errors.WithStack(err)
+		}
+		result = tc
+	}
+
+	return result, nil
+}
+
+// newMetadataCache creates the image metadata cache selected in the config.
+func newMetadataCache(config *Config) (cache.Cache, error) {
+	switch config.MetadataCache {
+	case "", CacheMemory:
+		return cache.NewMemoryCache(config.MetadataMemoryCache), nil
+	case CacheBolt:
+		bc, err := cache.NewBoltCache(config.CacheDir.JoinUnsafe(boltCacheFile), config.BoltCache)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return bc, nil
+	case CacheRedis:
+		rc, err := newRedisCache(config, "metadata:")
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return rc, nil
+	default:
+		return nil, errors.Errorf("Bad metadata cache: %v", config.MetadataCache)
+	}
+}
+
+// newRedisCache connects to the configured Redis server. Caches sharing it are kept apart by prefix.
+func newRedisCache(config *Config, prefix string) (*cache.RedisCache, error) {
+	redisConfig := config.Redis
+	redisConfig.Prefix += prefix
+	return cache.NewRedisCache(redisConfig)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/dchest/safefile"
+	"github.com/pkg/errors"
+
+	"github.com/fxkr/openview/backend"
+)
+
+// runCache implements the cache command, which exports and imports cache entries to pre-seed other hosts.
+//
+// Archives are written to and read from the file given as argument, or stdout/stdin if it's "-".
+// Reports go to stderr, so they don't mix with archives written to stdout.
+func runCache(app *backend.Application, args []string) error {
+	if len(args) != 2 {
+		return errors.New("Usage: cache export|import <file>")
+	}
+	path := args[1]
+
+	var report *backend.ArchiveReport
+	var err error
+	switch args[0] {
+	case "export":
+		report, err = exportCache(app, path)
+	case "import":
+		report, err = importCache(app, path)
+	default:
+		return errors.Errorf("Unknown cache command: %v", args[0])
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	fmt.Fprintf(os.Stderr, "%d cache entries (%d bytes) %sed, %d skipped\n", report.Entries, report.Size, args[0], report.Skipped)
+	for _, name := range report.Excluded {
+		fmt.Fprintf(os.Stderr, "The %s cache was left out, since it is kept in memory\n", name)
+	}
+	return nil
+}
+
+func exportCache(app *backend.Application, path string) (*backend.ArchiveReport, error) {
+	if path == "-" {
+		return app.ExportCache(os.Stdout)
+	}
+
+	// Don't leave half written archives behind.
+	f, err := safefile.Create(path, 0644)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	report, err := app.ExportCache(f)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	err = f.Commit()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return report, nil
+}
+
+func importCache(app *backend.Application, path string) (*backend.ArchiveReport, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	return app.ImportCache(r)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/namsral/flag"
+	"github.com/pkg/errors"
+
+	"github.com/fxkr/openview/backend"
+)
+
+// runGC implements the gc command, which deletes cache entries of deleted or changed images.
+func runGC(app *backend.Application, args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+	var dryrun = fs.Bool("dryrun", false, "only list orphaned and outdated cache entries, don't delete them")
+
+	err := fs.Parse(args)
+	if err != nil {
+		os.Exit(1) // flag prints its own errors
+	}
+
+	report, err := app.CollectGarbage(*dryrun, func(entry backend.GCEntry) {
+		fmt.Printf("%s\t%s\t%d\t%s\n", entry.Reason, entry.Cache, entry.Size, entry.Key)
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	action := "deleted"
+	if *dryrun {
+		action = "would be deleted"
+	}
+	fmt.Printf("%d of %d cache entries (%d bytes) %s\n", report.Garbage, report.Entries, report.Size, action)
+
+	return nil
+}
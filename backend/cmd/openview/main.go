@@ -2,13 +2,18 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"syscall"
+	"time"
 
 	"github.com/namsral/flag"
 	"github.com/pkg/errors"
 
 	"github.com/fxkr/openview/backend"
+	"github.com/fxkr/openview/backend/cache"
+	"github.com/fxkr/openview/backend/image"
+	"github.com/fxkr/openview/backend/model"
 	"github.com/fxkr/openview/backend/util/profiling"
 	"github.com/fxkr/openview/backend/util/safe"
 )
@@ -29,11 +34,59 @@ func run() error {
 	var cachedir = fs.String("cachedir", "", "path to cache directory (read-write)")
 	var imagedir = fs.String("imagedir", "", "path to image files (read-only)")
 
+	var thumbcache = fs.String("thumbcache", backend.CacheFile, "where to cache thumbnails: `file` (in cachedir) or redis")
+	var metadatacache = fs.String("metadatacache", backend.CacheMemory, "where to cache image metadata: `memory`, bolt (in cachedir, persistent) or redis")
+
+	var redisaddress = fs.String("redisaddress", "localhost:6379", "`address` of the Redis server of redis caches")
+	var redisnetwork = fs.String("redisnetwork", "tcp", "`network` of the Redis server (tcp or unix)")
+	var redispassword = fs.String("redispassword", "", "Redis `password` (default: none)")
+	var redisdb = fs.Int("redisdb", 0, "Redis database `number`")
+	var redistls = fs.Bool("redistls", false, "connect to Redis using TLS")
+	var redistlsskipverify = fs.Bool("redistlsskipverify", false, "don't verify the Redis server's TLS certificate")
+	var redisprefix = fs.String("redisprefix", "openview:", "`prefix` of Redis keys")
+	var redistimeout = fs.Duration("redistimeout", 5*time.Second, "`timeout` of connecting to Redis and of Redis commands (0: none)")
+	var redismaxidle = fs.Int("redismaxidle", 4, "largest `number` of idle Redis connections")
+	var redismaxactive = fs.Int("redismaxactive", 0, "largest `number` of open Redis connections (0: unlimited)")
+	var redisidletimeout = fs.Duration("redisidletimeout", 5*time.Minute, "`duration` after which idle Redis connections are closed (0: never)")
+	var redishealthcheck = fs.Duration("redishealthcheck", time.Minute, "idle `duration` after which Redis connections are checked before use")
+
+	var cachemaxsize = fs.Int64("cachemaxsize", 0, "largest total size of the thumbnail cache in `MiB` (0: unlimited)")
+	var cachemaxentries = fs.Int64("cachemaxentries", 0, "largest number of thumbnail cache entries (0: unlimited)")
+	var cachemetadata = fs.String("cachemetadata", "", "where to store thumbnail cache metadata: `xattr` or header (default: xattr if supported)")
+	var thumbmemorycachesize = fs.Int64("thumbmemorycachesize", 128, "size of the in-memory tier of the thumbnail cache in `MiB` (0: disabled)")
+	var thumbmemorycachemaxvalue = fs.Int64("thumbmemorycachemaxvalue", 1024, "largest thumbnail kept in the in-memory tier of the thumbnail cache in `KiB` (0: unlimited)")
+	var metadatacachesize = fs.Int64("metadatacachesize", 64, "largest size of the in-memory image metadata cache in `MiB` (0: unlimited)")
+	var boltcompactioninterval = fs.Duration("boltcompactioninterval", time.Hour, "`interval` of checking if the bolt metadata cache needs compaction (0: disabled)")
+	var placeholderimage = fs.String("placeholderimage", "", "path to image `file` served instead of thumbnails of broken images (read-only, default: built-in)")
+	var failurettl = fs.Duration("failurettl", 24*time.Hour, "how long to remember that an image can't be decoded (0: until it changes)")
+	var imageversioning = fs.String("imageversioning", backend.VersionModTime, "how to detect changed images: by `mtime` and size, or by content hash (memoised in the metadata cache)")
+	var cachecontrolresources = fs.String("cachecontrolresources", "no-cache", "Cache-Control header of frontend resources")
+	var cachecontrolfiles = fs.String("cachecontrolfiles", "no-cache", "Cache-Control header of original images and other files")
+	var cachecontrolrenditions = fs.String("cachecontrolrenditions", "no-cache", "Cache-Control header of thumbnails, contact sheets and Deep Zoom images")
+	var cachecontrolinfo = fs.String("cachecontrolinfo", "no-cache", "Cache-Control header of directory listings and image metadata")
+	var gcinterval = fs.Duration("gcinterval", 24*time.Hour, "`interval` of deleting cache entries of deleted or changed images (0: disabled)")
+
 	var memprofile = fs.String("memprofile", "", "on SIGUSR1, write memory profile to `file` (write-only)")
 	var cpuprofile = fs.String("cpuprofile", "", "on SIGUSR2, finish/restart cpu profile `file` (write-only)")
 
 	var listen = fs.String("listen", ":3000", "`address:port` to listen on")
 
+	var metadataworkers = fs.Int("metadataworkers", 0, "number of images to read metadata of in parallel (0: one per CPU)")
+
+	var displaysize = fs.Uint("displaysize", 0, "never serve originals, only renditions up to this size in `pixels` (0: disabled)")
+	var thumbsizes = fs.String("thumbsizes", "", "path to JSON thumbnail size table `file` (read-only)")
+	var animationmaxframes = fs.Uint("animationmaxframes", 300, "largest number of frames of animated thumbnails (0: disabled)")
+	var animationmaxpixels = fs.Uint("animationmaxpixels", 50000000, "largest number of pixels (width*height*frames) of animated thumbnails")
+	var thumbprofile = fs.String("thumbprofile", "srgb", "color `profile` for thumbnails (srgb or display-p3)")
+	var thumbembedprofile = fs.Bool("thumbembedprofile", false, "embed ICC profile in thumbnails (implied for display-p3)")
+
+	var watermarkimage = fs.String("watermarkimage", "", "path to watermark image `file` (read-only)")
+	var watermarktext = fs.String("watermarktext", "", "watermark `text`, if no watermark image is set")
+	var watermarkposition = fs.String("watermarkposition", "south-east", "watermark `position` (north-west, north, ..., center, ..., south-east)")
+	var watermarkopacity = fs.Float64("watermarkopacity", 0.5, "watermark `opacity` (0 to 1)")
+	var watermarkscale = fs.Float64("watermarkscale", 0.2, "watermark image size or text height relative to the image (0 to 1)")
+	var watermarkminsize = fs.Uint("watermarkminsize", 800, "smallest thumbnail size `pixels` to apply watermark to")
+
 	err := fs.Parse(os.Args[1:])
 	if err != nil {
 		os.Exit(1) // flag prints its own errors
@@ -48,6 +101,29 @@ func run() error {
 	if *imagedir == "" {
 		return errors.New("-imagedir is mandatory")
 	}
+	thumbSizes := model.DefaultThumbSizes
+	if *thumbsizes != "" {
+		buf, err := ioutil.ReadFile(*thumbsizes)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		thumbSizes, err = model.NewThumbSizes(buf)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	var redisPassword *string
+	if *redispassword != "" {
+		redisPassword = redispassword
+	}
+	colorProfile, err := image.NewColorProfile(*thumbprofile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	watermarkPosition, err := image.NewPosition(*watermarkposition)
+	if err != nil {
+		return errors.WithStack(err)
+	}
 	if *memprofile != "" {
 		profiling.SupportMemoryProfiling(*memprofile, syscall.SIGUSR1)
 	}
@@ -64,10 +140,92 @@ func run() error {
 		ImageDir:    safe.UnsafeNewPath(*imagedir),
 
 		ListenAddress: *listen,
+
+		ThumbnailCache: *thumbcache,
+		MetadataCache:  *metadatacache,
+
+		FileCache: cache.FileCacheConfig{
+			MaxSize:    *cachemaxsize << 20,
+			MaxEntries: *cachemaxentries,
+			Metadata:   *cachemetadata,
+		},
+
+		ThumbnailMemoryCache: cache.MemoryCacheConfig{
+			MaxSize: *thumbmemorycachesize << 20,
+		},
+		ThumbnailTieredCache: cache.TieredCacheConfig{
+			MaxPromoteSize: *thumbmemorycachemaxvalue << 10,
+		},
+		MetadataMemoryCache: cache.MemoryCacheConfig{
+			MaxSize: *metadatacachesize << 20,
+		},
+		BoltCache: cache.BoltCacheConfig{
+			CompactionInterval: *boltcompactioninterval,
+			ReadOnly:           fs.Arg(0) == "cache" && fs.Arg(1) == "export",
+		},
+		Redis: cache.RedisCacheConfig{
+			Host:                *redisaddress,
+			Network:             *redisnetwork,
+			Password:            redisPassword,
+			Prefix:              *redisprefix,
+			Database:            *redisdb,
+			TLS:                 *redistls,
+			TLSSkipVerify:       *redistlsskipverify,
+			ConnectTimeout:      *redistimeout,
+			ReadTimeout:         *redistimeout,
+			WriteTimeout:        *redistimeout,
+			MaxIdle:             *redismaxidle,
+			MaxActive:           *redismaxactive,
+			IdleTimeout:         *redisidletimeout,
+			HealthCheckInterval: *redishealthcheck,
+		},
+
+		GCInterval: *gcinterval,
+
+		PlaceholderImage: safe.UnsafeNewPath(*placeholderimage),
+		FailureTTL:       *failurettl,
+		ImageVersioning:  *imageversioning,
+
+		CacheControl: backend.CacheControlConfig{
+			Resources:  *cachecontrolresources,
+			Files:      *cachecontrolfiles,
+			Renditions: *cachecontrolrenditions,
+			Info:       *cachecontrolinfo,
+		},
+
+		MetadataWorkers: *metadataworkers,
+
+		DisplaySize: *displaysize,
+		ThumbSizes:  thumbSizes,
+		Animation: image.AnimationOptions{
+			MaxFrames: *animationmaxframes,
+			MaxPixels: *animationmaxpixels,
+		},
+		Thumbnail: image.ThumbnailOptions{
+			Profile:      colorProfile,
+			EmbedProfile: *thumbembedprofile,
+			Watermark: image.Watermark{
+				Image:    safe.UnsafeNewPath(*watermarkimage),
+				Text:     *watermarktext,
+				Position: watermarkPosition,
+				Opacity:  *watermarkopacity,
+				Scale:    *watermarkscale,
+				MinSize:  *watermarkminsize,
+			},
+		},
 	})
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
-	return errors.WithStack(app.Run())
+	switch fs.Arg(0) {
+	case "":
+		return errors.WithStack(app.Run())
+	case "gc":
+		return errors.WithStack(runGC(app, fs.Args()[1:]))
+	case "cache":
+		return errors.WithStack(runCache(app, fs.Args()[1:]))
+	default:
+		return errors.Errorf("Unknown command: %v", fs.Arg(0))
+	}
 }
@@ -1,6 +1,11 @@
 package backend
 
 import (
+	"time"
+
+	"github.com/fxkr/openview/backend/cache"
+	"github.com/fxkr/openview/backend/image"
+	"github.com/fxkr/openview/backend/model"
 	"github.com/fxkr/openview/backend/util/safe"
 )
 
@@ -10,4 +15,65 @@ type Config struct {
 	ImageDir    safe.Path
 
 	ListenAddress string
+
+	// ThumbnailCache is where thumbnails are cached: CacheFile (in CacheDir, the default) or CacheRedis.
+	ThumbnailCache string
+
+	// MetadataCache is where image metadata is cached: CacheMemory (the default), CacheBolt or CacheRedis.
+	MetadataCache string
+
+	// FileCache limits the thumbnail cache in CacheDir.
+	FileCache cache.FileCacheConfig
+
+	// ThumbnailMemoryCache limits the in-memory tier of the thumbnail cache. A MaxSize of zero disables it.
+	ThumbnailMemoryCache cache.MemoryCacheConfig
+
+	// ThumbnailTieredCache limits which thumbnails are promoted to the in-memory tier.
+	ThumbnailTieredCache cache.TieredCacheConfig
+
+	// MetadataMemoryCache limits the in-memory metadata cache.
+	MetadataMemoryCache cache.MemoryCacheConfig
+
+	// BoltCache configures the bolt metadata cache, whose database is in the CacheDir.
+	BoltCache cache.BoltCacheConfig
+
+	// Redis is the server of Redis caches. Their Prefix is extended to keep them apart.
+	Redis cache.RedisCacheConfig
+
+	// GCInterval is how often orphaned and outdated cache entries are deleted. Zero disables garbage collection.
+	GCInterval time.Duration
+
+	// ThumbSizes defaults to model.DefaultThumbSizes.
+	ThumbSizes *model.ThumbSizes
+	Thumbnail  image.ThumbnailOptions
+	Animation  image.AnimationOptions
+
+	// DisplaySize, if not zero, protects originals: images are only served as renditions of at most this size.
+	DisplaySize uint
+
+	// PlaceholderImage is served instead of thumbnails of images that can't be decoded. Empty means a built-in one.
+	PlaceholderImage safe.Path
+
+	// FailureTTL is how long failures to decode an image are cached. Zero means until the image changes.
+	FailureTTL time.Duration
+
+	// ImageVersioning is how changed images are detected: VersionModTime (the default) or VersionContentHash.
+	ImageVersioning string
+
+	// CacheControl is the Cache-Control header of responses, by endpoint.
+	CacheControl CacheControlConfig
+
+	// MetadataWorkers is the number of images whose metadata is read in parallel for a listing.
+	// Zero means one per CPU.
+	MetadataWorkers int
+}
+
+// CacheControlConfig holds Cache-Control headers by endpoint. Empty ones aren't sent.
+//
+// All responses have validators, so even "no-cache" only costs a request that's usually answered by 304 Not Modified.
+type CacheControlConfig struct {
+	Resources  string // Frontend resources
+	Files      string // Originals and other files in the image directory
+	Renditions string // Thumbnails, protected images, contact sheets and Deep Zoom images
+	Info       string // Directory listings and image metadata
 }
@@ -0,0 +1,230 @@
+package backend
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/fxkr/openview/backend/cache"
+	"github.com/fxkr/openview/backend/model"
+	"github.com/fxkr/openview/backend/util/safe"
+)
+
+// GCReport summarizes a cache garbage collection.
+type GCReport struct {
+	Entries int   // Number of entries scanned
+	Garbage int   // Number of orphaned or outdated entries
+	Size    int64 // Total size of orphaned or outdated entries
+}
+
+// GCEntry is an orphaned or outdated cache entry.
+type GCEntry struct {
+	Cache  string // "thumbnail" or "metadata"
+	Key    string
+	Reason string // "orphaned" or "outdated"
+	Size   int64
+}
+
+// errOrphaned is returned by getCurrentVersion for cache entries that would no longer be used at all.
+var errOrphaned = errors.New("Orphaned cache entry")
+
+// namedCache is a cache of the service, with the name used in reports and archives.
+type namedCache struct {
+	name  string
+	cache cache.Cache
+}
+
+func (s *service) caches() []namedCache {
+	return []namedCache{
+		{"thumbnail", s.thumbnailCache},
+		{"metadata", s.metadataCache},
+	}
+}
+
+// CollectGarbage deletes cache entries of images that were deleted or changed, reporting each to fn (which may be nil).
+//
+// With dryRun, entries are only reported.
+func (s *service) CollectGarbage(dryRun bool, fn func(GCEntry)) (*GCReport, error) {
+	report := &GCReport{}
+
+	for _, c := range s.caches() {
+		err := c.cache.Walk("", func(entry cache.Entry) error {
+			report.Entries++
+
+			reason, err := s.checkCacheEntry(entry)
+			if err != nil {
+				// Keep what can't be checked, e.g. because of a broken settings file.
+				log.WithError(err).WithField("key", entry.Key.String()).Warn("Failed to check cache entry")
+				return nil
+			}
+			if reason == "" {
+				return nil
+			}
+
+			report.Garbage++
+			report.Size += entry.Size
+			if fn != nil {
+				fn(GCEntry{c.name, entry.Key.String(), reason, entry.Size})
+			}
+
+			if dryRun {
+				return nil
+			}
+			return c.cache.Delete(entry.Key)
+		})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	return report, nil
+}
+
+// checkCacheEntry returns why a cache entry is garbage, or the empty string if it's still current.
+func (s *service) checkCacheEntry(entry cache.Entry) (string, error) {
+	version, err := s.getCurrentVersion(entry.Key.String())
+	if err == errOrphaned {
+		return "orphaned", nil
+	} else if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	if version.String() != entry.Version {
+		return "outdated", nil
+	}
+	return "", nil
+}
+
+// getCurrentVersion decodes a cache key and returns the version its entry would have if it was rendered now.
+//
+// It's the inverse of the key and version computations of the service methods, and must be kept in sync with them.
+func (s *service) getCurrentVersion(key string) (cache.Version, error) {
+	dec := json.NewDecoder(strings.NewReader(key))
+	dec.UseNumber()
+
+	var components []interface{}
+	err := dec.Decode(&components)
+	if err != nil || len(components) < 2 {
+		return nil, errOrphaned
+	}
+	kind, _ := components[0].(string)
+	pathStr, _ := components[1].(string)
+	args := components[2:]
+
+	path := safe.RelativePath{}
+	if pathStr != "." {
+		path, err = safe.NewRelativePath(pathStr)
+		if err != nil {
+			return nil, errOrphaned
+		}
+	}
+
+	fileInfo, err := os.Stat(s.base.Join(path).String())
+	if os.IsNotExist(err) {
+		return nil, errOrphaned
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if kind == "contact-sheet" {
+		columns, ok1 := uintArg(args, 0)
+		tileSize, ok2 := uintArg(args, 1)
+		if !fileInfo.IsDir() || !ok1 || !ok2 {
+			return nil, errOrphaned
+		}
+		sheet, err := s.getContactSheet(path, model.ContactSheet{Columns: columns, TileSize: tileSize})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return sheet.cacheVersion, nil
+	}
+
+	if !isImage(fileInfo) {
+		return nil, errOrphaned
+	}
+	switch kind {
+	case "imagemeta", "failed":
+		return s.getImageVersion(path, fileInfo), nil
+	case "contenthash":
+		if s.config.ImageVersioning != VersionContentHash {
+			return nil, errOrphaned
+		}
+		return getContentHashVersion(fileInfo), nil
+	}
+
+	settings, err := s.getSettings(path.Dir())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	switch kind {
+	case "thumbnail", "animated":
+		name, _ := stringArg(args, 0)
+		size, err := s.config.ThumbSizes.Get(name)
+		if err != nil || name == "" {
+			return nil, errOrphaned
+		}
+		size = settings.thumbSize(size)
+		return s.getThumbnailVersion(path, fileInfo, size, settings.Thumbnail.ForSize(size)), nil
+
+	case "display":
+		if settings.DisplaySize == 0 {
+			return nil, errOrphaned
+		}
+		size := settings.displaySize()
+		return s.getThumbnailVersion(path, fileInfo, size, settings.Thumbnail.ForSize(size)), nil
+
+	case "protected":
+		return s.getThumbnailVersion(path, fileInfo, settings.protectedSize(), settings.Thumbnail), nil
+
+	case "dzi-tile":
+		tileSize, ok1 := uintArg(args, 0)
+		level, ok2 := uintArg(args, 1)
+		col, ok3 := uintArg(args, 2)
+		row, ok4 := uintArg(args, 3)
+		if !ok1 || !ok2 || !ok3 || !ok4 {
+			return nil, errOrphaned
+		}
+		dz, err := s.getDeepZoom(path)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if dz.TileSize != tileSize || !dz.HasTile(level, col, row) {
+			return nil, errOrphaned
+		}
+		version, _, err := s.getDeepZoomVersion(path, fileInfo, dz)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return version, nil
+
+	default:
+		return nil, errOrphaned
+	}
+}
+
+func stringArg(args []interface{}, i int) (string, bool) {
+	if i >= len(args) {
+		return "", false
+	}
+	result, ok := args[i].(string)
+	return result, ok
+}
+
+func uintArg(args []interface{}, i int) (uint, bool) {
+	if i >= len(args) {
+		return 0, false
+	}
+	number, ok := args[i].(json.Number)
+	if !ok {
+		return 0, false
+	}
+	result, err := number.Int64()
+	if err != nil || result < 0 {
+		return 0, false
+	}
+	return uint(result), true
+}
@@ -0,0 +1,90 @@
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+
+	"github.com/fxkr/openview/backend/cache"
+	"github.com/fxkr/openview/backend/model"
+	"github.com/fxkr/openview/backend/util/safe"
+)
+
+func TestGC(t *testing.T) {
+	_ = Suite(&GCSuite{})
+	TestingT(t)
+}
+
+type GCSuite struct {
+	tempDir    safe.Path
+	service    *service
+	thumbnails *cache.FileCache
+	metadata   *cache.FileCache
+}
+
+func (s *GCSuite) SetUpTest(c *C) {
+	tempDir, err := ioutil.TempDir("", "openview-test")
+	if err != nil {
+		c.Fatalf("Error: %+v", errors.WithStack(err))
+	}
+	s.tempDir = safe.UnsafeNewPath(tempDir)
+
+	for _, dir := range []string{"thumbnails", "metadata", "images"} {
+		err = os.Mkdir(s.tempDir.JoinUnsafe(dir).String(), 0700)
+		c.Assert(err, IsNil)
+	}
+	err = ioutil.WriteFile(s.tempDir.JoinUnsafe("images").JoinUnsafe("a.jpg").String(), []byte("jpeg"), 0600)
+	c.Assert(err, IsNil)
+
+	s.thumbnails, err = cache.NewFileCache(s.tempDir.JoinUnsafe("thumbnails"), cache.FileCacheConfig{})
+	c.Assert(err, IsNil)
+	s.metadata, err = cache.NewFileCache(s.tempDir.JoinUnsafe("metadata"), cache.FileCacheConfig{})
+	c.Assert(err, IsNil)
+
+	s.service = NewService(&Config{
+		ImageDir:   s.tempDir.JoinUnsafe("images"),
+		ThumbSizes: model.DefaultThumbSizes,
+	}, s.thumbnails, s.metadata).(*service)
+}
+
+func (s *GCSuite) TearDownTest(c *C) {
+	s.thumbnails.Close()
+	s.metadata.Close()
+	os.RemoveAll(s.tempDir.String())
+}
+
+func (s *GCSuite) TestCollectGarbage(c *C) {
+	fileInfo, err := os.Stat(s.service.base.JoinUnsafe("a.jpg").String())
+	c.Assert(err, IsNil)
+	size, err := model.DefaultThumbSizes.Get("800")
+	c.Assert(err, IsNil)
+
+	c.Assert(s.metadata.Put(safe.NewKey("imagemeta", "a.jpg"), s.service.getImageVersion(safe.UnsafeNewRelativePath("a.jpg"), fileInfo), nil), IsNil)
+	c.Assert(s.thumbnails.Put(safe.NewKey("thumbnail", "a.jpg", "800"), s.service.getThumbnailVersion(safe.UnsafeNewRelativePath("a.jpg"), fileInfo, size, s.service.config.Thumbnail), nil), IsNil)
+
+	garbage := map[string]string{
+		safe.NewKey("imagemeta", "b.jpg").String():         "orphaned", // Deleted image
+		safe.NewKey("thumbnail", "a.jpg", "9999").String(): "orphaned", // Removed size
+		safe.NewKey("thumbnail", "a.jpg", "100").String():  "outdated",
+	}
+	c.Assert(s.metadata.Put(safe.NewKey("imagemeta", "b.jpg"), safe.NewKey("old"), []byte("x")), IsNil)
+	c.Assert(s.thumbnails.Put(safe.NewKey("thumbnail", "a.jpg", "9999"), safe.NewKey("old"), []byte("x")), IsNil)
+	c.Assert(s.thumbnails.Put(safe.NewKey("thumbnail", "a.jpg", "100"), safe.NewKey("old"), []byte("x")), IsNil)
+
+	for _, dryRun := range []bool{true, false} {
+		found := map[string]string{}
+		report, err := s.service.CollectGarbage(dryRun, func(entry GCEntry) {
+			found[entry.Key] = entry.Reason
+		})
+		c.Assert(err, IsNil)
+		c.Assert(found, DeepEquals, garbage)
+		c.Assert(*report, Equals, GCReport{Entries: 5, Garbage: 3, Size: 3})
+	}
+
+	report, err := s.service.CollectGarbage(false, nil)
+	c.Assert(err, IsNil)
+	c.Assert(*report, Equals, GCReport{Entries: 2})
+}
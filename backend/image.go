@@ -4,8 +4,11 @@ import (
 	"encoding/json"
 	"net/http"
 	"os"
+	"runtime"
+	"sync"
 
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 
 	"github.com/fxkr/openview/backend/cache"
 	"github.com/fxkr/openview/backend/image"
@@ -23,8 +26,18 @@ type ThumbnailOptions struct {
 	Height *int
 }
 
-func (s *service) getImageVersion(fileInfo os.FileInfo) cache.Version {
-	return safe.NewKey(fileInfo.ModTime(), fileInfo.Size())
+// getThumbnailVersion is like getImageVersion, but also covers the settings thumbnails are rendered with.
+//
+// Watermarks are versioned by modification time, since they aren't images in the image directory.
+func (s *service) getThumbnailVersion(path safe.RelativePath, fileInfo os.FileInfo, size model.ThumbSize, options image.ThumbnailOptions) cache.Version {
+	watermarkVersion := ""
+	if !options.Watermark.Image.IsEmpty() {
+		watermarkInfo, err := os.Stat(options.Watermark.Image.String())
+		if err == nil {
+			watermarkVersion = fileVersion(watermarkInfo).String()
+		}
+	}
+	return safe.NewKey(s.getImageVersion(path, fileInfo).String(), size, options, watermarkVersion)
 }
 
 func (s *service) getImageData(path safe.RelativePath) (*model.Image, error) {
@@ -37,7 +50,7 @@ func (s *service) getImageData(path safe.RelativePath) (*model.Image, error) {
 		return nil, handler.StatusError(http.StatusNotFound, errors.WithStack(err))
 	}
 
-	cacheVersion := s.getImageVersion(fileInfo)
+	cacheVersion := s.getImageVersion(path, fileInfo)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -47,7 +60,12 @@ func (s *service) getImageData(path safe.RelativePath) (*model.Image, error) {
 			return nil, nil, handler.StatusError(http.StatusNotFound, errors.WithStack(err))
 		}
 
-		value, err := image.GetImageData(fullPath)
+		var value *model.Image
+		err := s.decode(path, fileInfo, func() error {
+			var err error
+			value, err = image.GetImageData(fullPath)
+			return err
+		})
 		if err != nil {
 			return nil, nil, errors.WithStack(err)
 		}
@@ -75,5 +93,59 @@ func (s *service) getImageData(path safe.RelativePath) (*model.Image, error) {
 		return &model.Image{}, err
 	}
 
+	// Rendering may fail after the metadata was read, e.g. for truncated files.
+	_, result.Error = s.getFailure(path, cacheVersion)
+
 	return &result, nil
 }
+
+// getImagesData reads the metadata of several images in parallel. The result is in the same order as paths.
+//
+// Images whose metadata can't be read are logged and returned with Error set, rather than failing all of them.
+func (s *service) getImagesData(paths []safe.RelativePath) []model.Image {
+	return s.mapImages(paths, s.getImageData)
+}
+
+// mapImages implements getImagesData with MetadataWorkers goroutines, calling getImageData for each path.
+func (s *service) mapImages(paths []safe.RelativePath, getImageData func(safe.RelativePath) (*model.Image, error)) []model.Image {
+	workers := s.config.MetadataWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	result := make([]model.Image, len(paths))
+	indices := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(paths); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				img, err := getImageData(paths[i])
+				if err != nil {
+					if !isBroken(err) { // Already logged when it was decoded
+						log.WithError(err).WithField("path", paths[i].String()).Warn("Failed to read image metadata")
+					}
+					result[i] = model.Image{
+						Item: model.Item{
+							Name:         paths[i].Base(),
+							RelativePath: paths[i],
+						},
+						Error: true,
+					}
+					continue
+				}
+				result[i] = *img
+			}
+		}()
+	}
+
+	for i := range paths {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	return result
+}
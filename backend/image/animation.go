@@ -0,0 +1,159 @@
+package image
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/gographics/imagick.v2/imagick"
+
+	"github.com/fxkr/openview/backend/model"
+	"github.com/fxkr/openview/backend/util/safe"
+)
+
+// AnimationOptions limit which animations get animated thumbnails.
+//
+// Animations exceeding the limits get a still thumbnail of their first frame instead.
+type AnimationOptions struct {
+
+	// MaxFrames is the largest number of frames an animated thumbnail may have. Zero disables animated thumbnails.
+	MaxFrames uint `json:"max_frames"`
+
+	// MaxPixels is the largest number of pixels (width × height × frames) an animated thumbnail may have.
+	MaxPixels uint `json:"max_pixels"`
+}
+
+// Animate returns true if an animated thumbnail of size should be rendered for an image.
+func (o AnimationOptions) Animate(img *model.Image, size model.ThumbSize) bool {
+	if img.Frames <= 1 || img.Frames > o.MaxFrames {
+		return false
+	}
+	width, height := size.Fit(img.Width, img.Height)
+	return width*height*img.Frames <= o.MaxPixels
+}
+
+// AnimatedContentType returns the content type of animated thumbnails of an image.
+//
+// Animations keep their format, since JPEG can't be animated.
+func AnimatedContentType(fullPath safe.Path) string {
+	if strings.ToLower(filepath.Ext(fullPath.String())) == ".webp" {
+		return "image/webp"
+	}
+	return "image/gif"
+}
+
+// readImage reads the first frame of an image.
+//
+// Only the first frame is decoded, so still renditions of long animations are cheap.
+func readImage(fullPath safe.Path) (*imagick.MagickWand, error) {
+	mw := imagick.NewMagickWand()
+	err := mw.ReadImage(fullPath.String() + "[0]")
+	if err != nil {
+		mw.Destroy()
+		return nil, readError(err)
+	}
+	return mw, nil
+}
+
+// countFrames returns the number of frames of an image without decoding them.
+func countFrames(fullPath safe.Path) (uint, error) {
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+	err := mw.PingImage(fullPath.String())
+	if err != nil {
+		return 0, readError(err)
+	}
+	return mw.GetNumberImages(), nil
+}
+
+// RenderAnimatedThumbnail renders an animation scaled down to fit size.Pixel, keeping all frames, and writes it to w.
+//
+// The result has the same format as the original, see AnimatedContentType. Frames are oriented and color managed
+// like still thumbnails, except that GIFs are always converted to sRGB, since they can't carry an ICC profile.
+func RenderAnimatedThumbnail(w io.Writer, fullPath safe.Path, size model.ThumbSize, options ThumbnailOptions) error {
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+	err := mw.ReadImage(fullPath.String())
+	if err != nil {
+		return readError(err)
+	}
+
+	// Frames may be partial and offset, resizing them individually only works on complete frames.
+	coalesced := mw.CoalesceImages()
+	defer coalesced.Destroy()
+
+	gif := AnimatedContentType(fullPath) == "image/gif"
+	profile := options.Profile
+	if gif {
+		profile = ColorProfileSRGB
+	}
+
+	// Orientation and ICC profile are usually only stored with the first frame, but apply to all of them.
+	coalesced.SetIteratorIndex(0)
+	orientation := coalesced.GetImageOrientation()
+	icc := coalesced.GetImageProfile("icc")
+
+	coalesced.ResetIterator()
+	for coalesced.NextImage() {
+		err = coalesced.SetImageOrientation(orientation)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if icc != "" && coalesced.GetImageProfile("icc") == "" {
+			err = coalesced.SetImageProfile("icc", []byte(icc))
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		width, height := size.Fit(coalesced.GetImageWidth(), coalesced.GetImageHeight())
+
+		err = coalesced.ResizeImage(width, height, imagick.FILTER_LANCZOS, 1)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		err = convertProfile(coalesced, profile)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		err = coalesced.AutoOrientImage()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		err = coalesced.StripImage()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if options.Watermark.Enabled() {
+			err = applyWatermark(coalesced, options.Watermark)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		if !gif && (options.EmbedProfile || profile != ColorProfileSRGB) {
+			err = coalesced.SetImageProfile("icc", profile.ICC())
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		err = coalesced.SetImageCompressionQuality(size.Quality)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	// Turn frames back into partial frames, that's where most of the size savings of animations come from.
+	optimized := coalesced.OptimizeImageLayers()
+	defer optimized.Destroy()
+
+	optimized.ResetIterator()
+
+	return writeImage(w, optimized, true)
+}
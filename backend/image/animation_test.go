@@ -0,0 +1,39 @@
+package image
+
+import (
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/fxkr/openview/backend/model"
+	"github.com/fxkr/openview/backend/util/safe"
+)
+
+func TestAnimation(t *testing.T) {
+	_ = Suite(&AnimationSuite{})
+	TestingT(t)
+}
+
+type AnimationSuite struct {
+}
+
+func (s *AnimationSuite) TestAnimate(c *C) {
+	options := AnimationOptions{MaxFrames: 10, MaxPixels: 100 * 50 * 10}
+	size := model.ThumbSize{Pixel: 100}
+
+	c.Assert(options.Animate(&model.Image{Width: 200, Height: 100, Frames: 1}, size), Equals, false)
+	c.Assert(options.Animate(&model.Image{Width: 200, Height: 100, Frames: 2}, size), Equals, true)
+	c.Assert(options.Animate(&model.Image{Width: 200, Height: 100, Frames: 10}, size), Equals, true)
+	c.Assert(options.Animate(&model.Image{Width: 200, Height: 100, Frames: 11}, size), Equals, false) // MaxFrames
+
+	// MaxPixels counts the pixels of the thumbnail, not of the original.
+	c.Assert(options.Animate(&model.Image{Width: 2000, Height: 1000, Frames: 10}, size), Equals, true)
+	c.Assert(options.Animate(&model.Image{Width: 100, Height: 100, Frames: 10}, size), Equals, false)
+
+	c.Assert(AnimationOptions{}.Animate(&model.Image{Width: 200, Height: 100, Frames: 2}, size), Equals, false)
+}
+
+func (s *AnimationSuite) TestAnimatedContentType(c *C) {
+	c.Assert(AnimatedContentType(safe.UnsafeNewPath("/a/b.gif")), Equals, "image/gif")
+	c.Assert(AnimatedContentType(safe.UnsafeNewPath("/a/b.WebP")), Equals, "image/webp")
+}
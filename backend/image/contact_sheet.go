@@ -0,0 +1,83 @@
+package image
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+	"gopkg.in/gographics/imagick.v2/imagick"
+
+	"github.com/fxkr/openview/backend/model"
+)
+
+// ContactSheetTile is an image on a contact sheet.
+type ContactSheetTile struct {
+
+	// Thumbnail is an encoded thumbnail at least as large as the tiles.
+	Thumbnail []byte
+
+	// Caption is shown below the image, usually its filename.
+	Caption string
+}
+
+// ContactSheetSize holds the encoder settings for contact sheets.
+var ContactSheetSize = model.ThumbSize{
+	Name:              "contact-sheet",
+	Quality:           88,
+	Progressive:       true,
+	ChromaSubsampling: "4:2:0",
+}
+
+// RenderContactSheet renders a grid of captioned thumbnails and writes it to w.
+func RenderContactSheet(w io.Writer, tiles []ContactSheetTile, layout model.ContactSheet) error {
+	collection := imagick.NewMagickWand()
+	defer collection.Destroy()
+
+	for _, tile := range tiles {
+		mw := imagick.NewMagickWand()
+		err := mw.ReadImageBlob(tile.Thumbnail)
+		if err != nil {
+			mw.Destroy()
+			return errors.WithStack(err)
+		}
+
+		err = mw.LabelImage(tile.Caption)
+		if err == nil {
+			err = collection.AddImage(mw)
+		}
+		mw.Destroy()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if len(tiles) == 0 {
+		background := imagick.NewPixelWand()
+		defer background.Destroy()
+		background.SetColor("white")
+
+		err := collection.NewImage(layout.TileSize, layout.TileSize, background)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	dw := imagick.NewDrawingWand()
+	defer dw.Destroy()
+	dw.SetFontSize(float64(layout.TileSize) / 16)
+
+	tileGeometry := fmt.Sprintf("%dx", layout.Columns)
+	thumbnailGeometry := fmt.Sprintf("%dx%d>+%d+%d", layout.TileSize, layout.TileSize, layout.TileSize/20, layout.TileSize/20)
+
+	montage := collection.MontageImage(dw, tileGeometry, thumbnailGeometry, imagick.MONTAGE_MODE_UNFRAME, "0x0+0+0")
+	defer montage.Destroy()
+
+	err := encodeJPEG(montage, ContactSheetSize)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	montage.ResetIterator()
+
+	return writeImage(w, montage, false)
+}
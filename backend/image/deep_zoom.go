@@ -0,0 +1,105 @@
+package image
+
+import (
+	"github.com/pkg/errors"
+	"gopkg.in/gographics/imagick.v2/imagick"
+
+	"github.com/fxkr/openview/backend/model"
+	"github.com/fxkr/openview/backend/util/safe"
+)
+
+// DeepZoomSize holds the encoder settings for Deep Zoom tiles.
+var DeepZoomSize = model.ThumbSize{
+	Name:              "dzi",
+	Quality:           85,
+	ChromaSubsampling: "4:2:0",
+}
+
+// RenderDeepZoomBatch renders the tiles that are rendered together with a tile, see DeepZoom.Batch and DeepZoom.Block.
+//
+// Each level of the batch is scaled down from the previous one. Tiles are passed to fn as they are encoded.
+// Options are adjusted to each level's size with ForSize.
+func RenderDeepZoomBatch(fullPath safe.Path, dz model.DeepZoom, level uint, col uint, row uint, options ThumbnailOptions, fn func(level uint, col uint, row uint, tile []byte) error) error {
+	mw, err := readImage(fullPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer mw.Destroy()
+
+	err = mw.AutoOrientImage()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = convertProfile(mw, options.Profile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = mw.StripImage()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, l := range dz.Batch(level) {
+		width, height := dz.LevelSize(l)
+		if width != mw.GetImageWidth() || height != mw.GetImageHeight() {
+			err = mw.ResizeImage(width, height, imagick.FILTER_LANCZOS, 1)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		maxSize := width
+		if height > maxSize {
+			maxSize = height
+		}
+		levelOptions := options.ForSize(model.ThumbSize{Pixel: maxSize})
+
+		err := renderDeepZoomTiles(mw, dz, l, col, row, levelOptions, fn)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+// renderDeepZoomTiles cuts the block of tiles containing a tile out of the level image in mw.
+func renderDeepZoomTiles(mw *imagick.MagickWand, dz model.DeepZoom, level uint, col uint, row uint, options ThumbnailOptions, fn func(level uint, col uint, row uint, tile []byte) error) error {
+
+	// Keep mw free of watermarks, since smaller levels are scaled down from it.
+	if options.Watermark.Enabled() {
+		mw = mw.Clone()
+		defer mw.Destroy()
+
+		err := applyWatermark(mw, options.Watermark)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	firstCol, firstRow, cols, rows := dz.Block(level, col, row)
+	for r := firstRow; r < firstRow+rows; r++ {
+		for c := firstCol; c < firstCol+cols; c++ {
+			x, y, width, height := dz.TileRect(level, c, r)
+
+			tile := mw.GetImageRegion(width, height, int(x), int(y))
+			err := encodeJPEG(tile, DeepZoomSize)
+			if err != nil {
+				tile.Destroy()
+				return errors.WithStack(err)
+			}
+
+			blob := tile.GetImageBlob()
+			tile.Destroy()
+
+			err = fn(level, c, r, blob)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+
+	return nil
+}
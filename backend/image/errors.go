@@ -0,0 +1,30 @@
+package image
+
+import (
+	"github.com/pkg/errors"
+	"gopkg.in/gographics/imagick.v2/imagick"
+)
+
+// DecodeError is the cause of errors about images that are corrupt or in an unsupported format.
+//
+// Other failures, like I/O errors or exceeded resource limits, may go away when retried.
+type DecodeError struct {
+	Message string
+}
+
+func (e *DecodeError) Error() string {
+	return e.Message
+}
+
+// readError returns the error of reading an image, with a DecodeError as cause if ImageMagick couldn't decode it.
+func readError(err error) error {
+	if e, ok := err.(*imagick.MagickWandException); ok {
+		switch e.Kind() {
+		case imagick.EXCEPTION_CORRUPT_IMAGE_ERROR, imagick.EXCEPTION_CORRUPT_IMAGE_FATAL_ERROR,
+			imagick.EXCEPTION_MISSING_DELEGATE_ERROR, imagick.EXCEPTION_MISSING_DELEGATE_FATAL_ERROR,
+			imagick.EXCEPTION_CODER_ERROR, imagick.EXCEPTION_CODER_FATAL_ERROR:
+			return errors.WithStack(&DecodeError{e.Error()})
+		}
+	}
+	return errors.WithStack(err)
+}
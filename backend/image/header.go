@@ -0,0 +1,343 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// header is the metadata that can be read from an image file without decoding pixels.
+type header struct {
+	Width  uint
+	Height uint
+
+	// Orientation is the EXIF orientation (1 to 8), or 1 if the image has none.
+	Orientation uint
+
+	Frames uint
+}
+
+// errUnsupportedFormat is returned by readHeader for files it can't parse.
+var errUnsupportedFormat = errors.New("Unsupported image format")
+
+// readHeader reads the dimensions, orientation and number of frames of JPEG, PNG, GIF and WebP images.
+//
+// Only headers are parsed. Images that are corrupt beyond them are not detected.
+func readHeader(r io.Reader) (*header, error) {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(12)
+	if err != nil && len(magic) < 4 {
+		return nil, errUnsupportedFormat
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte("\xff\xd8")):
+		return readJPEGHeader(br)
+	case bytes.HasPrefix(magic, []byte("\x89PNG\r\n\x1a\n")):
+		return readPNGHeader(br)
+	case bytes.HasPrefix(magic, []byte("GIF87a")), bytes.HasPrefix(magic, []byte("GIF89a")):
+		return readGIFHeader(br)
+	case len(magic) == 12 && bytes.HasPrefix(magic, []byte("RIFF")) && bytes.Equal(magic[8:12], []byte("WEBP")):
+		return readWebPHeader(br)
+	default:
+		return nil, errUnsupportedFormat
+	}
+}
+
+func readJPEGHeader(r *bufio.Reader) (*header, error) {
+	result := &header{Orientation: 1, Frames: 1}
+
+	_, err := r.Discard(2) // SOI
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	for {
+		// Markers may be preceded by any number of fill bytes.
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if b != 0xff {
+			return nil, errors.New("Corrupt JPEG: expected marker")
+		}
+		marker, err := r.ReadByte()
+		for err == nil && marker == 0xff {
+			marker, err = r.ReadByte()
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		// Standalone markers without a segment
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			continue
+		}
+		if marker == 0xd9 || marker == 0xda {
+			return nil, errors.New("Corrupt JPEG: image data before frame header")
+		}
+
+		var length uint16
+		err = binary.Read(r, binary.BigEndian, &length)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if length < 2 {
+			return nil, errors.New("Corrupt JPEG: bad segment length")
+		}
+		segment := make([]byte, length-2)
+		_, err = io.ReadFull(r, segment)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")):
+			result.Orientation = readEXIFOrientation(segment[6:])
+
+		// Start of frame (all variants except DHT 0xc4, JPG 0xc8 and DAC 0xcc).
+		// EXIF comes before it, so parsing is done.
+		case marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc:
+			if len(segment) < 5 {
+				return nil, errors.New("Corrupt JPEG: short frame header")
+			}
+			result.Height = uint(binary.BigEndian.Uint16(segment[1:3]))
+			result.Width = uint(binary.BigEndian.Uint16(segment[3:5]))
+			return result, nil
+		}
+	}
+}
+
+// readEXIFOrientation returns the orientation from a TIFF structure, or 1 if it has none or is corrupt.
+func readEXIFOrientation(tiff []byte) uint {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := order.Uint32(tiff[4:8])
+	if uint64(ifd)+2 > uint64(len(tiff)) {
+		return 1
+	}
+	entries := uint64(order.Uint16(tiff[ifd:]))
+	for i := uint64(0); i < entries; i++ {
+		entry := uint64(ifd) + 2 + i*12
+		if entry+12 > uint64(len(tiff)) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 { // Orientation, a SHORT stored in the value field
+			orientation := uint(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+func readPNGHeader(r *bufio.Reader) (*header, error) {
+	var ihdr struct {
+		Signature [8]byte
+		Length    uint32
+		Type      [4]byte
+		Width     uint32
+		Height    uint32
+	}
+	err := binary.Read(r, binary.BigEndian, &ihdr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if string(ihdr.Type[:]) != "IHDR" {
+		return nil, errors.New("Corrupt PNG: IHDR is not the first chunk")
+	}
+
+	return &header{
+		Width:       uint(ihdr.Width),
+		Height:      uint(ihdr.Height),
+		Orientation: 1,
+		Frames:      1,
+	}, nil
+}
+
+func readGIFHeader(r *bufio.Reader) (*header, error) {
+	var screen struct {
+		Signature [6]byte
+		Width     uint16
+		Height    uint16
+		Flags     byte
+		_         [2]byte
+	}
+	err := binary.Read(r, binary.LittleEndian, &screen)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	result := &header{
+		Width:       uint(screen.Width),
+		Height:      uint(screen.Height),
+		Orientation: 1,
+	}
+
+	if screen.Flags&0x80 != 0 { // Global color table
+		_, err = r.Discard(3 << (screen.Flags&0x07 + 1))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	// Count frames by skipping over blocks, without decompressing them.
+	for {
+		introducer, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		switch introducer {
+		case 0x21: // Extension
+			_, err = r.Discard(1) // Label
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+
+		case 0x2c: // Image descriptor
+			var descriptor [9]byte
+			_, err = io.ReadFull(r, descriptor[:])
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			if descriptor[8]&0x80 != 0 { // Local color table
+				_, err = r.Discard(3 << (descriptor[8]&0x07 + 1))
+				if err != nil {
+					return nil, errors.WithStack(err)
+				}
+			}
+			_, err = r.Discard(1) // LZW minimum code size
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			result.Frames++
+
+		case 0x3b: // Trailer
+			if result.Frames == 0 {
+				return nil, errors.New("Corrupt GIF: no frames")
+			}
+			return result, nil
+
+		default:
+			return nil, errors.New("Corrupt GIF: bad block")
+		}
+
+		// Both extensions and images are followed by data sub-blocks, terminated by an empty one.
+		for {
+			size, err := r.ReadByte()
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			if size == 0 {
+				break
+			}
+			_, err = r.Discard(int(size))
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+	}
+}
+
+func readWebPHeader(r *bufio.Reader) (*header, error) {
+	_, err := r.Discard(12) // RIFF header
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var result *header
+	for {
+		var chunk struct {
+			Type   [4]byte
+			Length uint32
+		}
+		err := binary.Read(r, binary.LittleEndian, &chunk)
+		if err == io.EOF && result != nil {
+			return result, nil
+		} else if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		// Chunks are padded to an even length.
+		length := int(chunk.Length + chunk.Length&1)
+
+		switch string(chunk.Type[:]) {
+		case "VP8 ": // Lossy
+			data, err := r.Peek(10)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			if !bytes.Equal(data[3:6], []byte("\x9d\x01\x2a")) {
+				return nil, errors.New("Corrupt WebP: bad VP8 start code")
+			}
+			return &header{
+				Width:       uint(binary.LittleEndian.Uint16(data[6:8]) & 0x3fff),
+				Height:      uint(binary.LittleEndian.Uint16(data[8:10]) & 0x3fff),
+				Orientation: 1,
+				Frames:      1,
+			}, nil
+
+		case "VP8L": // Lossless
+			data, err := r.Peek(5)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			if data[0] != 0x2f {
+				return nil, errors.New("Corrupt WebP: bad VP8L signature")
+			}
+			bits := binary.LittleEndian.Uint32(data[1:5])
+			return &header{
+				Width:       uint(bits&0x3fff) + 1,
+				Height:      uint(bits>>14&0x3fff) + 1,
+				Orientation: 1,
+				Frames:      1,
+			}, nil
+
+		case "VP8X": // Extended
+			data, err := r.Peek(10)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			result = &header{
+				Width:       (uint(data[4]) | uint(data[5])<<8 | uint(data[6])<<16) + 1,
+				Height:      (uint(data[7]) | uint(data[8])<<8 | uint(data[9])<<16) + 1,
+				Orientation: 1,
+				Frames:      1,
+			}
+			if data[0]&0x02 == 0 { // Not animated
+				return result, nil
+			}
+			result.Frames = 0
+
+		case "ANMF": // Animation frame
+			if result == nil {
+				return nil, errors.New("Corrupt WebP: animation frame without VP8X chunk")
+			}
+			result.Frames++
+		}
+
+		_, err = r.Discard(length)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+}
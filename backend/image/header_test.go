@@ -0,0 +1,98 @@
+package image
+
+import (
+	"bytes"
+	goimage "image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestHeader(t *testing.T) {
+	_ = Suite(&HeaderSuite{})
+	TestingT(t)
+}
+
+type HeaderSuite struct {
+}
+
+func (s *HeaderSuite) TestJPEG(c *C) {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, goimage.NewGray(goimage.Rect(0, 0, 30, 20)), nil)
+	c.Assert(err, IsNil)
+
+	h, err := readHeader(&buf)
+	c.Assert(err, IsNil)
+	c.Assert(*h, Equals, header{Width: 30, Height: 20, Orientation: 1, Frames: 1})
+}
+
+func (s *HeaderSuite) TestJPEGWithOrientation(c *C) {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, goimage.NewGray(goimage.Rect(0, 0, 30, 20)), nil)
+	c.Assert(err, IsNil)
+
+	exif := []byte("Exif\x00\x00" +
+		"MM\x00\x2a\x00\x00\x00\x08" + // TIFF header, IFD0 at offset 8
+		"\x00\x01" + // One entry
+		"\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00" + // Orientation = 6
+		"\x00\x00\x00\x00") // No next IFD
+	app1 := append([]byte{0xff, 0xe1, 0, byte(len(exif) + 2)}, exif...)
+	withEXIF := append(append([]byte{0xff, 0xd8}, app1...), buf.Bytes()[2:]...)
+
+	h, err := readHeader(bytes.NewReader(withEXIF))
+	c.Assert(err, IsNil)
+	c.Assert(*h, Equals, header{Width: 30, Height: 20, Orientation: 6, Frames: 1})
+}
+
+func (s *HeaderSuite) TestPNG(c *C) {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, goimage.NewGray(goimage.Rect(0, 0, 300, 200)))
+	c.Assert(err, IsNil)
+
+	h, err := readHeader(&buf)
+	c.Assert(err, IsNil)
+	c.Assert(*h, Equals, header{Width: 300, Height: 200, Orientation: 1, Frames: 1})
+}
+
+func (s *HeaderSuite) TestAnimatedGIF(c *C) {
+	palette := color.Palette{color.Black, color.White}
+	frames := &gif.GIF{}
+	for i := 0; i < 3; i++ {
+		frames.Image = append(frames.Image, goimage.NewPaletted(goimage.Rect(0, 0, 40, 10), palette))
+		frames.Delay = append(frames.Delay, 10)
+	}
+
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, frames)
+	c.Assert(err, IsNil)
+
+	h, err := readHeader(&buf)
+	c.Assert(err, IsNil)
+	c.Assert(*h, Equals, header{Width: 40, Height: 10, Orientation: 1, Frames: 3})
+}
+
+func (s *HeaderSuite) TestLosslessWebP(c *C) {
+	// Width 50 and height 25 are stored minus one in 14 bits each.
+	bits := uint32(49) | uint32(24)<<14
+	webp := []byte("RIFF\x1a\x00\x00\x00WEBPVP8L\x0d\x00\x00\x00\x2f")
+	webp = append(webp, byte(bits), byte(bits>>8), byte(bits>>16), byte(bits>>24))
+	webp = append(webp, make([]byte, 9)...)
+
+	h, err := readHeader(bytes.NewReader(webp))
+	c.Assert(err, IsNil)
+	c.Assert(*h, Equals, header{Width: 50, Height: 25, Orientation: 1, Frames: 1})
+}
+
+func (s *HeaderSuite) TestUnsupported(c *C) {
+	_, err := readHeader(bytes.NewReader([]byte("II\x2a\x00 this is a TIFF")))
+	c.Assert(err, Equals, errUnsupportedFormat)
+}
+
+func (s *HeaderSuite) TestTruncatedJPEG(c *C) {
+	_, err := readHeader(bytes.NewReader([]byte{0xff, 0xd8, 0xff, 0xe0, 0x00}))
+	c.Assert(err, NotNil)
+}
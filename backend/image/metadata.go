@@ -1,6 +1,8 @@
 package image
 
 import (
+	"os"
+
 	"github.com/pkg/errors"
 	"gopkg.in/gographics/imagick.v2/imagick"
 
@@ -8,23 +10,22 @@ import (
 	"github.com/fxkr/openview/backend/util/safe"
 )
 
+// GetImageData returns the dimensions (as displayed, i.e. after applying the orientation) of an image.
+//
+// Common formats are handled by parsing their headers, only others are decoded with ImageMagick.
 func GetImageData(fullPath safe.Path) (*model.Image, error) {
-	mw := imagick.NewMagickWand()
-	defer mw.Destroy()
-
-	err := mw.ReadImage(fullPath.String())
+	h, err := getHeader(fullPath)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		h, err = getHeaderImageMagick(fullPath)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
 	}
 
-	width := mw.GetImageWidth()
-	height := mw.GetImageHeight()
+	width, height := h.Width, h.Height
 
-	orientation := mw.GetImageOrientation()
-	if orientation == imagick.ORIENTATION_LEFT_TOP ||
-		orientation == imagick.ORIENTATION_RIGHT_TOP ||
-		orientation == imagick.ORIENTATION_RIGHT_BOTTOM ||
-		orientation == imagick.ORIENTATION_LEFT_BOTTOM {
+	// Orientations 5 to 8 (left top, right top, right bottom, left bottom) are rotated by 90 degrees.
+	if h.Orientation >= 5 && h.Orientation <= 8 {
 		width, height = height, width
 	}
 
@@ -33,5 +34,48 @@ func GetImageData(fullPath safe.Path) (*model.Image, error) {
 
 		Width:  width,
 		Height: height,
+		Frames: h.Frames,
+	}, nil
+}
+
+func getHeader(fullPath safe.Path) (*header, error) {
+	f, err := os.Open(fullPath.String())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	return readHeader(f)
+}
+
+func getHeaderImageMagick(fullPath safe.Path) (*header, error) {
+	mw, err := readImage(fullPath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer mw.Destroy()
+
+	frames, err := countFrames(fullPath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	orientation := uint(1)
+	switch mw.GetImageOrientation() {
+	case imagick.ORIENTATION_LEFT_TOP:
+		orientation = 5
+	case imagick.ORIENTATION_RIGHT_TOP:
+		orientation = 6
+	case imagick.ORIENTATION_RIGHT_BOTTOM:
+		orientation = 7
+	case imagick.ORIENTATION_LEFT_BOTTOM:
+		orientation = 8
+	}
+
+	return &header{
+		Width:       mw.GetImageWidth(),
+		Height:      mw.GetImageHeight(),
+		Orientation: orientation,
+		Frames:      frames,
 	}, nil
 }
@@ -0,0 +1,169 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// ColorProfile names an RGB color space thumbnails can be rendered in.
+type ColorProfile string
+
+const (
+	ColorProfileSRGB      ColorProfile = "srgb"
+	ColorProfileDisplayP3 ColorProfile = "display-p3"
+)
+
+func NewColorProfile(s string) (ColorProfile, error) {
+	switch ColorProfile(s) {
+	case "":
+		return ColorProfileSRGB, nil
+	case ColorProfileSRGB, ColorProfileDisplayP3:
+		return ColorProfile(s), nil
+	default:
+		return "", errors.Errorf("Bad color profile: %v", s)
+	}
+}
+
+// ICC returns a compact ICC profile describing the color space.
+func (p ColorProfile) ICC() []byte {
+	switch p {
+	case ColorProfileDisplayP3:
+		return displayP3Profile
+	default:
+		return sRGBProfile
+	}
+}
+
+var (
+	// Primaries are chromatically adapted to D50, as the ICC profile connection space requires.
+	sRGBProfile = newICCProfile("sRGB", [3][3]float64{
+		{0.4360747, 0.2225045, 0.0139322},
+		{0.3850649, 0.7168786, 0.0971045},
+		{0.1430804, 0.0606169, 0.7141733},
+	})
+	displayP3Profile = newICCProfile("Display P3", [3][3]float64{
+		{0.5151024, 0.2411823, -0.0010502},
+		{0.2919654, 0.6922360, 0.0418826},
+		{0.1571530, 0.0665817, 0.7840782},
+	})
+)
+
+// iccCurvePoints is the number of entries in the tone reproduction curve.
+//
+// The sRGB curve is smooth enough that linear interpolation between 256 points is visually exact.
+const iccCurvePoints = 256
+
+// newICCProfile builds a minimal ICC v2 display profile (matrix/TRC) with the sRGB tone curve.
+//
+// The result is about 1 KiB, small enough to embed in every thumbnail.
+func newICCProfile(description string, primaries [3][3]float64) []byte {
+	type tag struct {
+		signature string
+		data      []byte
+	}
+
+	curve := newICCCurve()
+	tags := []tag{
+		{"desc", newICCDescription(description)},
+		{"cprt", newICCText("No copyright, use freely")},
+		{"wtpt", newICCXYZ([3]float64{0.9642, 1.0, 0.8249})},
+		{"rXYZ", newICCXYZ(primaries[0])},
+		{"gXYZ", newICCXYZ(primaries[1])},
+		{"bXYZ", newICCXYZ(primaries[2])},
+		{"rTRC", curve},
+		{"gTRC", curve},
+		{"bTRC", curve},
+	}
+
+	// Lay out tag data after the header and tag table.
+	// Identical data (the three curves) is stored once and referenced by all tags.
+	var data bytes.Buffer
+	offsets := make([]uint32, len(tags))
+	dataStart := 128 + 4 + 12*len(tags)
+	for i, t := range tags {
+		if i > 0 && bytes.Equal(t.data, tags[i-1].data) {
+			offsets[i] = offsets[i-1]
+			continue
+		}
+		offsets[i] = uint32(dataStart + data.Len())
+		data.Write(t.data)
+		for data.Len()%4 != 0 {
+			data.WriteByte(0)
+		}
+	}
+
+	var buf bytes.Buffer
+	size := uint32(dataStart + data.Len())
+
+	// Header
+	header := make([]byte, 128)
+	binary.BigEndian.PutUint32(header[0:], size)
+	binary.BigEndian.PutUint32(header[8:], 0x02100000) // Version 2.1
+	copy(header[12:], "mntr")
+	copy(header[16:], "RGB ")
+	copy(header[20:], "XYZ ")
+	copy(header[36:], "acsp")
+	copy(header[68:], newICCXYZ([3]float64{0.9642, 1.0, 0.8249})[8:]) // D50 illuminant
+	buf.Write(header)
+
+	// Tag table
+	binary.Write(&buf, binary.BigEndian, uint32(len(tags)))
+	for i, t := range tags {
+		buf.WriteString(t.signature)
+		binary.Write(&buf, binary.BigEndian, offsets[i])
+		binary.Write(&buf, binary.BigEndian, uint32(len(t.data)))
+	}
+
+	buf.Write(data.Bytes())
+	return buf.Bytes()
+}
+
+func newICCXYZ(xyz [3]float64) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("XYZ ")
+	buf.Write(make([]byte, 4))
+	for _, v := range xyz {
+		binary.Write(&buf, binary.BigEndian, int32(math.Round(v*65536)))
+	}
+	return buf.Bytes()
+}
+
+func newICCText(text string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("text")
+	buf.Write(make([]byte, 4))
+	buf.WriteString(text)
+	buf.WriteByte(0)
+	return buf.Bytes()
+}
+
+func newICCDescription(text string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("desc")
+	buf.Write(make([]byte, 4))
+	binary.Write(&buf, binary.BigEndian, uint32(len(text)+1))
+	buf.WriteString(text)
+	buf.WriteByte(0)
+	buf.Write(make([]byte, 4+4+2+1+67)) // Empty Unicode and ScriptCode descriptions
+	return buf.Bytes()
+}
+
+func newICCCurve() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("curv")
+	buf.Write(make([]byte, 4))
+	binary.Write(&buf, binary.BigEndian, uint32(iccCurvePoints))
+	for i := 0; i < iccCurvePoints; i++ {
+		v := float64(i) / (iccCurvePoints - 1)
+		if v <= 0.04045 {
+			v = v / 12.92
+		} else {
+			v = math.Pow((v+0.055)/1.055, 2.4)
+		}
+		binary.Write(&buf, binary.BigEndian, uint16(math.Round(v*65535)))
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,104 @@
+package image
+
+import (
+	"encoding/binary"
+	"testing"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/gographics/imagick.v2/imagick"
+)
+
+func TestProfile(t *testing.T) {
+	_ = Suite(&ProfileSuite{})
+	TestingT(t)
+}
+
+type ProfileSuite struct {
+}
+
+var profiles = []ColorProfile{ColorProfileSRGB, ColorProfileDisplayP3}
+
+func (s *ProfileSuite) TestHeader(c *C) {
+	for _, p := range profiles {
+		icc := p.ICC()
+		c.Assert(len(icc) >= 128, Equals, true, Commentf("%v", p))
+		c.Check(binary.BigEndian.Uint32(icc[0:]), Equals, uint32(len(icc)), Commentf("%v", p))
+		c.Check(string(icc[36:40]), Equals, "acsp", Commentf("%v", p))
+		c.Check(string(icc[12:16]), Equals, "mntr", Commentf("%v", p))
+		c.Check(string(icc[16:20]), Equals, "RGB ", Commentf("%v", p))
+	}
+}
+
+func (s *ProfileSuite) TestTags(c *C) {
+	for _, p := range profiles {
+		icc := p.ICC()
+		count := int(binary.BigEndian.Uint32(icc[128:]))
+		c.Assert(count, Equals, 9, Commentf("%v", p))
+
+		dataStart := 128 + 4 + 12*count
+		for i := 0; i < count; i++ {
+			entry := icc[128+4+12*i:]
+			signature := string(entry[0:4])
+			offset := int(binary.BigEndian.Uint32(entry[4:]))
+			length := int(binary.BigEndian.Uint32(entry[8:]))
+
+			comment := Commentf("%v %v", p, signature)
+			c.Check(offset >= dataStart, Equals, true, comment)
+			c.Check(offset%4, Equals, 0, comment)
+			c.Check(length > 0, Equals, true, comment)
+			c.Check(offset+length <= len(icc), Equals, true, comment)
+		}
+	}
+}
+
+func (s *ProfileSuite) TestProfileImage(c *C) {
+	for _, p := range profiles {
+		mw := newColorImage(c)
+		defer mw.Destroy()
+
+		c.Check(mw.ProfileImage("icc", p.ICC()), IsNil, Commentf("%v", p))
+	}
+}
+
+func (s *ProfileSuite) TestConvertProfile(c *C) {
+	mw := newColorImage(c)
+	defer mw.Destroy()
+	before := pixelColor(c, mw)
+
+	// Tag as Display P3, then convert to sRGB: the same numbers mean a more saturated color in P3.
+	c.Assert(mw.ProfileImage("icc", ColorProfileDisplayP3.ICC()), IsNil)
+	c.Assert(convertProfile(mw, ColorProfileSRGB), IsNil)
+	after := pixelColor(c, mw)
+
+	c.Assert(after, Not(DeepEquals), before)
+	c.Assert(after[0] > before[0], Equals, true) // Red gets more intense
+}
+
+func (s *ProfileSuite) TestConvertProfileUntagged(c *C) {
+	mw := newColorImage(c)
+	defer mw.Destroy()
+	before := pixelColor(c, mw)
+
+	// Untagged images are sRGB already.
+	c.Assert(convertProfile(mw, ColorProfileSRGB), IsNil)
+	c.Assert(pixelColor(c, mw), DeepEquals, before)
+}
+
+func newColorImage(c *C) *imagick.MagickWand {
+	pw := imagick.NewPixelWand()
+	defer pw.Destroy()
+	pw.SetColor("rgb(200,100,50)")
+
+	mw := imagick.NewMagickWand()
+	c.Assert(mw.NewImage(4, 4, pw), IsNil)
+	c.Assert(mw.SetImageFormat("png"), IsNil)
+	return mw
+}
+
+// pixelColor returns the 8 bit RGB values of the top left pixel.
+func pixelColor(c *C, mw *imagick.MagickWand) [3]int {
+	pw, err := mw.GetImagePixelColor(0, 0)
+	c.Assert(err, IsNil)
+	defer pw.Destroy()
+	return [3]int{int(pw.GetRed()*255 + 0.5), int(pw.GetGreen()*255 + 0.5), int(pw.GetBlue()*255 + 0.5)}
+}
@@ -1,6 +1,9 @@
 package image
 
 import (
+	"io"
+	"os"
+
 	"github.com/pkg/errors"
 	"gopkg.in/gographics/imagick.v2/imagick"
 
@@ -8,49 +11,207 @@ import (
 	"github.com/fxkr/openview/backend/util/safe"
 )
 
-func RenderThumbnail(fullPath safe.Path, size model.ThumbSize) ([]byte, error) {
-	mw := imagick.NewMagickWand()
-	defer mw.Destroy()
-	err := mw.ReadImage(fullPath.String())
-	if err != nil {
-		return nil, errors.WithStack(err)
+// ThumbnailOptions control how thumbnails are encoded.
+//
+// They are part of the thumbnail cache version, so changing them invalidates existing thumbnails.
+type ThumbnailOptions struct {
+
+	// Profile is the color space thumbnails are converted to.
+	Profile ColorProfile `json:"profile"`
+
+	// EmbedProfile embeds an ICC profile for Profile in each thumbnail.
+	//
+	// Untagged images are assumed to be sRGB by browsers, so this is implied for other profiles.
+	EmbedProfile bool `json:"embed_profile"`
+
+	// Watermark is applied to thumbnails of at least Watermark.MinSize and protected originals.
+	Watermark Watermark `json:"watermark"`
+}
+
+// ForSize returns the options that apply to thumbnails of a specific size.
+func (o ThumbnailOptions) ForSize(size model.ThumbSize) ThumbnailOptions {
+	if size.Pixel < o.Watermark.MinSize {
+		o.Watermark = Watermark{}
 	}
+	return o
+}
 
-	width := mw.GetImageWidth()
-	height := mw.GetImageHeight()
+// ProtectedSize holds the encoder settings for protected originals and display size renditions.
+//
+// Its Pixel is zero, so images are not scaled down unless a display size is set.
+var ProtectedSize = model.ThumbSize{
+	Name:              "protected",
+	Quality:           92,
+	Progressive:       true,
+	ChromaSubsampling: "4:4:4",
+}
 
-	maxOldSize := width
-	if height > maxOldSize {
-		maxOldSize = height
+// RenderThumbnail renders an image scaled down to fit size.Pixel (0: unlimited) and writes it to w.
+//
+// Metadata is stripped. For thumbnails, the options should have been adjusted to the size with ForSize.
+func RenderThumbnail(w io.Writer, fullPath safe.Path, size model.ThumbSize, options ThumbnailOptions) error {
+	mw, err := readImage(fullPath)
+	if err != nil {
+		return errors.WithStack(err)
 	}
+	defer mw.Destroy()
+
+	oldWidth, oldHeight := mw.GetImageWidth(), mw.GetImageHeight()
+	width, height := size.Fit(oldWidth, oldHeight)
+
+	if width != oldWidth || height != oldHeight {
+		err = mw.ResizeImage(width, height, imagick.FILTER_LANCZOS, 1)
+		if err != nil {
+			return errors.WithStack(err)
+		}
 
-	if maxOldSize > size.Pixel {
-		factor := float32(size.Pixel) / float32(maxOldSize)
-		width = uint(float32(width) * factor)
-		height = uint(float32(height) * factor)
+		// Downscaling softens edges, unsharp masking restores some crispness.
+		if size.Sharpen > 0 {
+			err = mw.UnsharpMaskImage(0, 0.75, size.Sharpen, 0.008)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
 	}
 
-	err = mw.ResizeImage(width, height, imagick.FILTER_LANCZOS, 1)
+	err = convertProfile(mw, options.Profile)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return errors.WithStack(err)
 	}
 
 	err = mw.AutoOrientImage()
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return errors.WithStack(err)
 	}
 
-	err = mw.SetImageCompressionQuality(95)
+	// Drop EXIF, XMP, comments and profiles. Thumbnails don't need them, and they can be large.
+	err = mw.StripImage()
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return errors.WithStack(err)
 	}
 
-	err = mw.SetImageFormat("JPG")
+	if options.Watermark.Enabled() {
+		err = applyWatermark(mw, options.Watermark)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if options.EmbedProfile || options.Profile != ColorProfileSRGB {
+		err = mw.SetImageProfile("icc", options.Profile.ICC())
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	err = encodeJPEG(mw, size)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return errors.WithStack(err)
 	}
 
 	mw.ResetIterator()
 
-	return mw.GetImageBlob(), nil
+	return writeImage(w, mw, false)
+}
+
+// encodeJPEG sets up mw to produce a JPEG with the encoder settings of size.
+func encodeJPEG(mw *imagick.MagickWand, size model.ThumbSize) error {
+
+	// JPEG has no alpha channel. Put transparent areas (of PNGs and GIFs) on white rather than black.
+	background := imagick.NewPixelWand()
+	defer background.Destroy()
+	background.SetColor("white")
+	err := mw.SetImageBackgroundColor(background)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = mw.SetImageAlphaChannel(imagick.ALPHA_CHANNEL_REMOVE)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = mw.SetImageFormat("JPG")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = mw.SetImageCompressionQuality(size.Quality)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	interlace := imagick.INTERLACE_NO
+	if size.Progressive {
+		interlace = imagick.INTERLACE_PLANE
+	}
+	err = mw.SetImageInterlaceScheme(interlace)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if size.ChromaSubsampling != "" {
+		err = mw.SetOption("jpeg:sampling-factor", size.ChromaSubsampling)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+// writeImage writes the current image of mw to w, or all its images (frames) with all.
+//
+// Files, like the temporary files the file cache is filled through, are written to by ImageMagick directly.
+// Other writers get the encoded image in one piece.
+func writeImage(w io.Writer, mw *imagick.MagickWand, all bool) error {
+	if f, ok := w.(*os.File); ok {
+		var err error
+		if all {
+			err = mw.WriteImagesFile(f)
+		} else {
+			err = mw.WriteImageFile(f)
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return nil
+	}
+
+	blob := mw.GetImageBlob()
+	if all {
+		blob = mw.GetImagesBlob()
+	}
+	_, err := w.Write(blob)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// convertProfile converts the image to the target color space, using its embedded ICC profile if it has one.
+func convertProfile(mw *imagick.MagickWand, target ColorProfile) error {
+	if mw.GetImageProfile("icc") == "" {
+		if mw.GetImageColorspace() == imagick.COLORSPACE_CMYK {
+			err := mw.TransformImageColorspace(imagick.COLORSPACE_SRGB)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		if target == ColorProfileSRGB {
+			return nil // Untagged images are sRGB already
+		}
+
+		// Assigning a profile to an image without one doesn't convert, so tag it as sRGB first.
+		err := mw.ProfileImage("icc", ColorProfileSRGB.ICC())
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	err := mw.ProfileImage("icc", target.ICC())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
 }
@@ -0,0 +1,191 @@
+package image
+
+import (
+	"github.com/pkg/errors"
+	"gopkg.in/gographics/imagick.v2/imagick"
+
+	"github.com/fxkr/openview/backend/util/safe"
+)
+
+// Watermark is an image or text overlaid on rendered images.
+//
+// The zero value is a disabled watermark.
+type Watermark struct {
+
+	// Image is the path of an image file to overlay. Alpha channels are respected.
+	Image safe.Path `json:"image"`
+
+	// Text is overlaid if no Image is set.
+	Text string `json:"text"`
+
+	// Position is the edge or corner the watermark is placed at.
+	Position Position `json:"position"`
+
+	// Opacity ranges from 0 (invisible) to 1 (opaque).
+	Opacity float64 `json:"opacity"`
+
+	// Scale ranges from 0 to 1. An image watermark is fitted within that fraction of the width and height
+	// of the image it's applied to; a text watermark is that fraction of the height tall.
+	Scale float64 `json:"scale"`
+
+	// MinSize is the smallest thumbnail size (in pixels) watermarks are applied to.
+	//
+	// Small thumbnails aren't worth protecting and a watermark would cover most of them.
+	MinSize uint `json:"min_size"`
+}
+
+// Enabled returns true if there is anything to overlay.
+func (w Watermark) Enabled() bool {
+	return !w.Image.IsEmpty() || w.Text != ""
+}
+
+// Validate returns an error if Opacity or Scale are out of range.
+func (w Watermark) Validate() error {
+	if w.Opacity < 0 || w.Opacity > 1 {
+		return errors.Errorf("Bad watermark opacity: %v", w.Opacity)
+	}
+	if w.Scale < 0 || w.Scale > 1 {
+		return errors.Errorf("Bad watermark scale: %v", w.Scale)
+	}
+	return nil
+}
+
+// Position is a compass direction or "center".
+type Position string
+
+var positionGravities = map[Position]imagick.GravityType{
+	"north-west": imagick.GRAVITY_NORTH_WEST,
+	"north":      imagick.GRAVITY_NORTH,
+	"north-east": imagick.GRAVITY_NORTH_EAST,
+	"west":       imagick.GRAVITY_WEST,
+	"center":     imagick.GRAVITY_CENTER,
+	"east":       imagick.GRAVITY_EAST,
+	"south-west": imagick.GRAVITY_SOUTH_WEST,
+	"south":      imagick.GRAVITY_SOUTH,
+	"south-east": imagick.GRAVITY_SOUTH_EAST,
+}
+
+const DefaultPosition Position = "south-east"
+
+func NewPosition(s string) (Position, error) {
+	if s == "" {
+		return DefaultPosition, nil
+	}
+	if _, ok := positionGravities[Position(s)]; !ok {
+		return "", errors.Errorf("Bad watermark position: %v", s)
+	}
+	return Position(s), nil
+}
+
+func (p Position) gravity() imagick.GravityType {
+	gravity, ok := positionGravities[p]
+	if !ok {
+		return positionGravities[DefaultPosition]
+	}
+	return gravity
+}
+
+// offset returns where an overlay of the given size goes on an image of the given size.
+func (p Position) offset(width, height, overlayWidth, overlayHeight, margin uint) (int, int) {
+	left := int(margin)
+	centerX := (int(width) - int(overlayWidth)) / 2
+	right := int(width) - int(overlayWidth) - int(margin)
+	top := int(margin)
+	centerY := (int(height) - int(overlayHeight)) / 2
+	bottom := int(height) - int(overlayHeight) - int(margin)
+
+	switch p {
+	case "north-west":
+		return left, top
+	case "north":
+		return centerX, top
+	case "north-east":
+		return right, top
+	case "west":
+		return left, centerY
+	case "center":
+		return centerX, centerY
+	case "east":
+		return right, centerY
+	case "south-west":
+		return left, bottom
+	case "south":
+		return centerX, bottom
+	default:
+		return right, bottom
+	}
+}
+
+// applyWatermark overlays the watermark on the current image of mw.
+func applyWatermark(mw *imagick.MagickWand, w Watermark) error {
+	width := mw.GetImageWidth()
+	height := mw.GetImageHeight()
+
+	margin := width
+	if height < margin {
+		margin = height
+	}
+	margin = margin / 50
+
+	if !w.Image.IsEmpty() {
+		overlay := imagick.NewMagickWand()
+		defer overlay.Destroy()
+
+		err := overlay.ReadImage(w.Image.String())
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		// Fit within the scaled width and height, keeping the aspect ratio.
+		factor := float64(width) * w.Scale / float64(overlay.GetImageWidth())
+		if heightFactor := float64(height) * w.Scale / float64(overlay.GetImageHeight()); heightFactor < factor {
+			factor = heightFactor
+		}
+		overlayWidth := uint(float64(overlay.GetImageWidth()) * factor)
+		overlayHeight := uint(float64(overlay.GetImageHeight()) * factor)
+		if overlayWidth == 0 || overlayHeight == 0 {
+			return nil
+		}
+
+		err = overlay.ResizeImage(overlayWidth, overlayHeight, imagick.FILTER_LANCZOS, 1)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		err = overlay.SetImageAlphaChannel(imagick.ALPHA_CHANNEL_ACTIVATE)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		err = overlay.EvaluateImageChannel(imagick.CHANNEL_ALPHA, imagick.EVAL_OP_MULTIPLY, w.Opacity)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		x, y := w.Position.offset(width, height, overlayWidth, overlayHeight, margin)
+		err = mw.CompositeImage(overlay, imagick.COMPOSITE_OP_OVER, x, y)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		return nil
+	}
+
+	dw := imagick.NewDrawingWand()
+	defer dw.Destroy()
+	pw := imagick.NewPixelWand()
+	defer pw.Destroy()
+
+	pw.SetColor("white")
+	dw.SetFillColor(pw)
+	dw.SetFillOpacity(w.Opacity)
+	dw.SetFontSize(float64(height) * w.Scale)
+	dw.SetGravity(w.Position.gravity())
+
+	err := mw.AnnotateImage(dw, float64(margin), float64(margin), 0, w.Text)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package backend
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+
+	"github.com/fxkr/openview/backend/model"
+	"github.com/fxkr/openview/backend/util/safe"
+)
+
+func TestImage(t *testing.T) {
+	_ = Suite(&ImageSuite{})
+	TestingT(t)
+}
+
+type ImageSuite struct {
+}
+
+func (s *ImageSuite) TestMapImages(c *C) {
+	svc := &service{config: &Config{MetadataWorkers: 4}}
+
+	var paths []safe.RelativePath
+	for _, name := range []string{"a.jpg", "b.jpg", "broken.jpg", "c.jpg", "d.jpg", "missing.jpg", "e.jpg"} {
+		paths = append(paths, safe.UnsafeNewRelativePath(name))
+	}
+
+	result := svc.mapImages(paths, func(path safe.RelativePath) (*model.Image, error) {
+		// Finish out of order.
+		time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+
+		switch path.Base() {
+		case "broken.jpg":
+			return nil, &brokenImageError{"corrupt"}
+		case "missing.jpg":
+			return nil, errors.New("no such file")
+		}
+		return &model.Image{Item: model.Item{Name: path.Base(), RelativePath: path}, Width: 1}, nil
+	})
+
+	c.Assert(result, HasLen, len(paths))
+	for i, img := range result {
+		c.Assert(img.Name, Equals, paths[i].Base())
+		c.Assert(img.RelativePath, Equals, paths[i])
+
+		failed := img.Name == "broken.jpg" || img.Name == "missing.jpg"
+		c.Assert(img.Error, Equals, failed, Commentf("%s", img.Name))
+		c.Assert(img.Width == 1, Equals, !failed, Commentf("%s", img.Name))
+	}
+}
@@ -0,0 +1,52 @@
+package model
+
+import (
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultContactSheetColumns  = 5
+	MaxContactSheetColumns      = 20
+	DefaultContactSheetTileSize = 240
+	MaxContactSheetTileSize     = 500
+
+	// MaxContactSheetItems is the largest number of images on a contact sheet.
+	// Larger directories are cut off.
+	MaxContactSheetItems = 500
+)
+
+// ContactSheet describes the layout of a contact sheet.
+type ContactSheet struct {
+	Columns  uint `json:"columns"`
+	TileSize uint `json:"tile_size"`
+}
+
+func NewContactSheet(columns string, tileSize string) (ContactSheet, error) {
+	result := ContactSheet{DefaultContactSheetColumns, DefaultContactSheetTileSize}
+
+	if columns != "" {
+		columnsUint, err := strconv.ParseUint(columns, 10, 16)
+		if err != nil {
+			return ContactSheet{}, errors.WithStack(err)
+		}
+		if columnsUint == 0 || columnsUint > MaxContactSheetColumns {
+			return ContactSheet{}, errors.Errorf("Bad number of columns: %v", columns)
+		}
+		result.Columns = uint(columnsUint)
+	}
+
+	if tileSize != "" {
+		tileSizeUint, err := strconv.ParseUint(tileSize, 10, 16)
+		if err != nil {
+			return ContactSheet{}, errors.WithStack(err)
+		}
+		if tileSizeUint == 0 || tileSizeUint > MaxContactSheetTileSize {
+			return ContactSheet{}, errors.Errorf("Bad tile size: %v", tileSize)
+		}
+		result.TileSize = uint(tileSizeUint)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,43 @@
+package model
+
+import (
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestContactSheet(t *testing.T) {
+	_ = Suite(&ContactSheetSuite{})
+	TestingT(t)
+}
+
+type ContactSheetSuite struct {
+}
+
+func (s *ContactSheetSuite) TestNewContactSheet(c *C) {
+	sheet, err := NewContactSheet("", "")
+	c.Assert(err, IsNil)
+	c.Assert(sheet, Equals, ContactSheet{DefaultContactSheetColumns, DefaultContactSheetTileSize})
+
+	sheet, err = NewContactSheet("1", "1")
+	c.Assert(err, IsNil)
+	c.Assert(sheet, Equals, ContactSheet{1, 1})
+
+	sheet, err = NewContactSheet("20", "500")
+	c.Assert(err, IsNil)
+	c.Assert(sheet, Equals, ContactSheet{MaxContactSheetColumns, MaxContactSheetTileSize})
+
+	for _, args := range [][2]string{
+		{"0", ""},
+		{"21", ""},
+		{"-1", ""},
+		{"x", ""},
+		{"", "0"},
+		{"", "501"},
+		{"", "65536"},
+		{"", "1.5"},
+	} {
+		_, err := NewContactSheet(args[0], args[1])
+		c.Assert(err, NotNil, Commentf("%v", args))
+	}
+}
@@ -0,0 +1,156 @@
+package model
+
+import (
+	"encoding/xml"
+)
+
+const (
+	DeepZoomTileSize = 254
+	DeepZoomOverlap  = 1
+
+	// DeepZoomBatchSize is the largest level size (in pixels) rendered together with all smaller levels.
+	//
+	// The smallest levels consist of a handful of tiles and are cheap to render from each other,
+	// so it's wasteful to decode the original image for each of them.
+	DeepZoomBatchSize = 2048
+
+	// DeepZoomBlockTiles is the number of tiles per side of the blocks that larger levels are rendered in,
+	// so a request doesn't render all tiles of a huge level.
+	DeepZoomBlockTiles = 8
+)
+
+// DeepZoom describes the tile pyramid of an image in Deep Zoom (DZI) format.
+//
+// Level 0 is a single pixel, each level is twice the size of the previous one,
+// and the last level is the image's full size.
+type DeepZoom struct {
+	Width    uint `json:"width"`
+	Height   uint `json:"height"`
+	TileSize uint `json:"tile_size"`
+	Overlap  uint `json:"overlap"`
+}
+
+func NewDeepZoom(width uint, height uint) DeepZoom {
+	return DeepZoom{width, height, DeepZoomTileSize, DeepZoomOverlap}
+}
+
+// MaxLevel returns the level at which the image has its full size.
+func (d DeepZoom) MaxLevel() uint {
+	maxSize := d.Width
+	if d.Height > maxSize {
+		maxSize = d.Height
+	}
+
+	level := uint(0)
+	for (uint(1) << level) < maxSize {
+		level++
+	}
+	return level
+}
+
+// LevelSize returns the size of the image at a level.
+func (d DeepZoom) LevelSize(level uint) (uint, uint) {
+	scale := uint(1) << (d.MaxLevel() - level)
+	return (d.Width + scale - 1) / scale, (d.Height + scale - 1) / scale
+}
+
+// Tiles returns the number of columns and rows of tiles of a level.
+func (d DeepZoom) Tiles(level uint) (uint, uint) {
+	width, height := d.LevelSize(level)
+	return (width + d.TileSize - 1) / d.TileSize, (height + d.TileSize - 1) / d.TileSize
+}
+
+// HasTile returns true if the tile exists.
+func (d DeepZoom) HasTile(level uint, col uint, row uint) bool {
+	if level > d.MaxLevel() {
+		return false
+	}
+	cols, rows := d.Tiles(level)
+	return col < cols && row < rows
+}
+
+// TileRect returns the area of the level image covered by a tile, including overlap.
+func (d DeepZoom) TileRect(level uint, col uint, row uint) (x uint, y uint, width uint, height uint) {
+	levelWidth, levelHeight := d.LevelSize(level)
+	x, width = d.tileSpan(col, levelWidth)
+	y, height = d.tileSpan(row, levelHeight)
+	return
+}
+
+func (d DeepZoom) tileSpan(index uint, levelSize uint) (uint, uint) {
+	start := index * d.TileSize
+	end := start + d.TileSize + d.Overlap
+	if index > 0 {
+		start -= d.Overlap
+	}
+	if end > levelSize {
+		end = levelSize
+	}
+	return start, end - start
+}
+
+// Batch returns the levels that should be rendered together with a level, in descending order.
+func (d DeepZoom) Batch(level uint) []uint {
+	width, height := d.LevelSize(level)
+	if width > DeepZoomBatchSize || height > DeepZoomBatchSize {
+		return []uint{level}
+	}
+
+	batch := make([]uint, 0)
+	for l := d.MaxLevel(); ; l-- {
+		width, height := d.LevelSize(l)
+		if width <= DeepZoomBatchSize && height <= DeepZoomBatchSize {
+			batch = append(batch, l)
+		}
+		if l == 0 {
+			break
+		}
+	}
+	return batch
+}
+
+// Block returns the tiles of a level that should be rendered together with a tile,
+// as first column and row and number of columns and rows.
+//
+// Levels batched with others are rendered whole, larger ones in blocks of DeepZoomBlockTiles × DeepZoomBlockTiles tiles.
+func (d DeepZoom) Block(level uint, col uint, row uint) (uint, uint, uint, uint) {
+	cols, rows := d.Tiles(level)
+	width, height := d.LevelSize(level)
+	if width <= DeepZoomBatchSize && height <= DeepZoomBatchSize {
+		return 0, 0, cols, rows
+	}
+
+	firstCol, firstRow := col/DeepZoomBlockTiles*DeepZoomBlockTiles, row/DeepZoomBlockTiles*DeepZoomBlockTiles
+	return firstCol, firstRow, minUint(DeepZoomBlockTiles, cols-firstCol), minUint(DeepZoomBlockTiles, rows-firstRow)
+}
+
+func minUint(a uint, b uint) uint {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// DeepZoomDescriptor is the XML representation of a DZI descriptor.
+type DeepZoomDescriptor struct {
+	XMLName  xml.Name `xml:"http://schemas.microsoft.com/deepzoom/2008 Image"`
+	Format   string   `xml:"Format,attr"`
+	Overlap  uint     `xml:"Overlap,attr"`
+	TileSize uint     `xml:"TileSize,attr"`
+	Size     struct {
+		Width  uint `xml:"Width,attr"`
+		Height uint `xml:"Height,attr"`
+	} `xml:"Size"`
+}
+
+// Descriptor returns the DZI descriptor. Tiles are JPEG.
+func (d DeepZoom) Descriptor() *DeepZoomDescriptor {
+	result := &DeepZoomDescriptor{
+		Format:   "jpg",
+		Overlap:  d.Overlap,
+		TileSize: d.TileSize,
+	}
+	result.Size.Width = d.Width
+	result.Size.Height = d.Height
+	return result
+}
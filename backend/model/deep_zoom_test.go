@@ -0,0 +1,78 @@
+package model
+
+import (
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestDeepZoom(t *testing.T) {
+	_ = Suite(&DeepZoomSuite{})
+	TestingT(t)
+}
+
+type DeepZoomSuite struct {
+}
+
+func (s *DeepZoomSuite) TestMaxLevel(c *C) {
+	c.Assert(NewDeepZoom(1, 1).MaxLevel(), Equals, uint(0))
+	c.Assert(NewDeepZoom(2, 1).MaxLevel(), Equals, uint(1))
+	c.Assert(NewDeepZoom(1000, 600).MaxLevel(), Equals, uint(10))
+	c.Assert(NewDeepZoom(1024, 600).MaxLevel(), Equals, uint(10))
+	c.Assert(NewDeepZoom(600, 1025).MaxLevel(), Equals, uint(11))
+}
+
+func (s *DeepZoomSuite) TestLevelSize(c *C) {
+	dz := NewDeepZoom(1000, 600)
+	width, height := dz.LevelSize(10)
+	c.Assert([]uint{width, height}, DeepEquals, []uint{1000, 600})
+	width, height = dz.LevelSize(9)
+	c.Assert([]uint{width, height}, DeepEquals, []uint{500, 300})
+	width, height = dz.LevelSize(1)
+	c.Assert([]uint{width, height}, DeepEquals, []uint{2, 2})
+	width, height = dz.LevelSize(0)
+	c.Assert([]uint{width, height}, DeepEquals, []uint{1, 1})
+}
+
+func (s *DeepZoomSuite) TestTiles(c *C) {
+	dz := NewDeepZoom(1000, 600)
+	cols, rows := dz.Tiles(10)
+	c.Assert([]uint{cols, rows}, DeepEquals, []uint{4, 3})
+	c.Assert(dz.HasTile(10, 3, 2), Equals, true)
+	c.Assert(dz.HasTile(10, 4, 2), Equals, false)
+	c.Assert(dz.HasTile(11, 0, 0), Equals, false)
+}
+
+func (s *DeepZoomSuite) TestTileRect(c *C) {
+	dz := NewDeepZoom(1000, 600)
+	x, y, width, height := dz.TileRect(10, 0, 0)
+	c.Assert([]uint{x, y, width, height}, DeepEquals, []uint{0, 0, 255, 255})
+	x, y, width, height = dz.TileRect(10, 1, 1)
+	c.Assert([]uint{x, y, width, height}, DeepEquals, []uint{253, 253, 256, 256})
+	x, y, width, height = dz.TileRect(10, 3, 2)
+	c.Assert([]uint{x, y, width, height}, DeepEquals, []uint{761, 507, 239, 93})
+}
+
+func (s *DeepZoomSuite) TestBatch(c *C) {
+	dz := NewDeepZoom(10000, 6000)
+	c.Assert(dz.Batch(14), DeepEquals, []uint{14})
+	c.Assert(dz.Batch(12), DeepEquals, []uint{12})
+	c.Assert(dz.Batch(3), DeepEquals, []uint{11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0})
+}
+
+func (s *DeepZoomSuite) TestBlock(c *C) {
+	dz := NewDeepZoom(10000, 6000) // Level 14 has 40 × 24 tiles
+
+	col, row, cols, rows := dz.Block(14, 0, 0)
+	c.Assert([]uint{col, row, cols, rows}, DeepEquals, []uint{0, 0, 8, 8})
+	col, row, cols, rows = dz.Block(14, 17, 9)
+	c.Assert([]uint{col, row, cols, rows}, DeepEquals, []uint{16, 8, 8, 8})
+	col, row, cols, rows = dz.Block(14, 39, 23)
+	c.Assert([]uint{col, row, cols, rows}, DeepEquals, []uint{32, 16, 8, 8})
+
+	col, row, cols, rows = dz.Block(13, 19, 11) // 20 × 12 tiles
+	c.Assert([]uint{col, row, cols, rows}, DeepEquals, []uint{16, 8, 4, 4})
+
+	col, row, cols, rows = dz.Block(10, 3, 1) // Batched with smaller levels
+	c.Assert([]uint{col, row, cols, rows}, DeepEquals, []uint{0, 0, 3, 2})
+}
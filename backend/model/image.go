@@ -5,4 +5,10 @@ type Image struct {
 
 	Width  uint `json:"width"`
 	Height uint `json:"height"`
+
+	// Frames is the number of frames of an animation (GIF, WebP). Still images have a single frame.
+	Frames uint `json:"frames"`
+
+	// Error is set if the image couldn't be read. Its dimensions may be unknown then.
+	Error bool `json:"error,omitempty"`
 }
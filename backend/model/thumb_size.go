@@ -1,32 +1,133 @@
 package model
 
 import (
+	"encoding/json"
+
 	"github.com/pkg/errors"
 )
 
+// ThumbSize is a thumbnail size and the encoder settings used for it.
 type ThumbSize struct {
 	Name  string `json:"name"`
 	Pixel uint   `json:"pixel"`
+
+	// Quality is the JPEG quality (1 to 100).
+	Quality uint `json:"quality"`
+
+	// Progressive enables progressive (interlaced) JPEG encoding.
+	Progressive bool `json:"progressive"`
+
+	// ChromaSubsampling is "4:2:0", "4:2:2" or "4:4:4". Empty means the encoder's default.
+	ChromaSubsampling string `json:"chroma_subsampling"`
+
+	// Sharpen is the amount of unsharp masking applied after downscaling. Zero disables sharpening.
+	Sharpen float64 `json:"sharpen"`
+}
+
+// Fit returns the dimensions of an image of the given dimensions scaled down to fit the size.
+//
+// Images are never scaled up. A Pixel of zero means no limit.
+func (s ThumbSize) Fit(width, height uint) (uint, uint) {
+	maxOldSize := width
+	if height > maxOldSize {
+		maxOldSize = height
+	}
+
+	if s.Pixel != 0 && maxOldSize > s.Pixel {
+		factor := float32(s.Pixel) / float32(maxOldSize)
+		width = uint(float32(width) * factor)
+		height = uint(float32(height) * factor)
+	}
+
+	return width, height
+}
+
+// ThumbSizes is the table of thumbnail sizes clients can request.
+type ThumbSizes struct {
+
+	// Default is the Name of the size used if a client doesn't request one.
+	Default string `json:"default"`
+
+	Sizes []ThumbSize `json:"sizes"`
 }
 
 var (
-	ThumbSizes = map[string]ThumbSize{
-		"":     ThumbSize{"800", 800}, // "default"
-		"100":  ThumbSize{"100", 100},
-		"240":  ThumbSize{"240", 240},
-		"360":  ThumbSize{"360", 360},
-		"500":  ThumbSize{"500", 500},
-		"800":  ThumbSize{"800", 800},
-		"1024": ThumbSize{"1024", 1024},
-		"1600": ThumbSize{"1600", 1600},
-		"2048": ThumbSize{"2048", 2048},
+	DefaultThumbSizes = &ThumbSizes{
+		Default: "800",
+		Sizes: []ThumbSize{
+			{Name: "100", Pixel: 100, Quality: 80, Progressive: false, ChromaSubsampling: "4:2:0", Sharpen: 0.8},
+			{Name: "240", Pixel: 240, Quality: 82, Progressive: false, ChromaSubsampling: "4:2:0", Sharpen: 0.6},
+			{Name: "360", Pixel: 360, Quality: 85, Progressive: false, ChromaSubsampling: "4:2:0", Sharpen: 0.5},
+			{Name: "500", Pixel: 500, Quality: 85, Progressive: true, ChromaSubsampling: "4:2:0", Sharpen: 0.4},
+			{Name: "800", Pixel: 800, Quality: 88, Progressive: true, ChromaSubsampling: "4:2:0", Sharpen: 0.3},
+			{Name: "1024", Pixel: 1024, Quality: 90, Progressive: true, ChromaSubsampling: "4:2:0", Sharpen: 0.3},
+			{Name: "1600", Pixel: 1600, Quality: 90, Progressive: true, ChromaSubsampling: "4:4:4", Sharpen: 0},
+			{Name: "2048", Pixel: 2048, Quality: 92, Progressive: true, ChromaSubsampling: "4:4:4", Sharpen: 0},
+		},
 	}
 )
 
-func NewThumbSize(s string) (ThumbSize, error) {
-	result, ok := ThumbSizes[s]
-	if !ok {
-		return ThumbSize{}, errors.Errorf("Bad thumbnail size: %v", s)
+// NewThumbSizes parses and validates a JSON thumbnail size table.
+func NewThumbSizes(data []byte) (*ThumbSizes, error) {
+	var result ThumbSizes
+	err := json.Unmarshal(data, &result)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	names := make(map[string]bool)
+	for _, size := range result.Sizes {
+		if size.Name == "" || names[size.Name] {
+			return nil, errors.Errorf("Bad thumbnail size: missing or duplicate name: %v", size.Name)
+		}
+		names[size.Name] = true
+
+		if size.Pixel == 0 {
+			return nil, errors.Errorf("Bad thumbnail size %v: pixel must not be zero", size.Name)
+		}
+		if size.Quality < 1 || size.Quality > 100 {
+			return nil, errors.Errorf("Bad thumbnail size %v: quality must be between 1 and 100", size.Name)
+		}
+		switch size.ChromaSubsampling {
+		case "", "4:2:0", "4:2:2", "4:4:4":
+		default:
+			return nil, errors.Errorf("Bad thumbnail size %v: bad chroma subsampling: %v", size.Name, size.ChromaSubsampling)
+		}
+		if size.Sharpen < 0 {
+			return nil, errors.Errorf("Bad thumbnail size %v: sharpen must not be negative", size.Name)
+		}
+	}
+	if !names[result.Default] {
+		return nil, errors.Errorf("Bad default thumbnail size: %v", result.Default)
+	}
+
+	return &result, nil
+}
+
+// AtLeast returns the smallest size of at least the given number of pixels, or the largest size if there is none.
+func (t *ThumbSizes) AtLeast(pixel uint) ThumbSize {
+	var result ThumbSize
+	for i, size := range t.Sizes {
+		if i == 0 {
+			result = size
+		} else if result.Pixel < pixel && size.Pixel > result.Pixel {
+			result = size
+		} else if size.Pixel >= pixel && size.Pixel < result.Pixel {
+			result = size
+		}
+	}
+	return result
+}
+
+// Get looks up a size by name. The empty name refers to the default size.
+func (t *ThumbSizes) Get(name string) (ThumbSize, error) {
+	if name == "" {
+		name = t.Default
+	}
+	for _, size := range t.Sizes {
+		if size.Name == name {
+			return size, nil
+		}
 	}
-	return result, nil
+	return ThumbSize{}, errors.Errorf("Bad thumbnail size: %v", name)
 }
@@ -0,0 +1,68 @@
+package model
+
+import (
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestThumbSize(t *testing.T) {
+	_ = Suite(&ThumbSizeSuite{})
+	TestingT(t)
+}
+
+type ThumbSizeSuite struct {
+}
+
+func (s *ThumbSizeSuite) TestNewThumbSizes(c *C) {
+	sizes, err := NewThumbSizes([]byte(`{"default": "b", "sizes": [
+		{"name": "b", "pixel": 500, "quality": 85},
+		{"name": "a", "pixel": 100, "quality": 80, "chroma_subsampling": "4:4:4"}
+	]}`))
+	c.Assert(err, IsNil)
+	c.Assert(sizes.Default, Equals, "b")
+	c.Assert(sizes.Sizes, DeepEquals, []ThumbSize{
+		{Name: "b", Pixel: 500, Quality: 85},
+		{Name: "a", Pixel: 100, Quality: 80, ChromaSubsampling: "4:4:4"},
+	})
+
+	for _, data := range []string{
+		`{"default": "a", "sizes": [{"name": "a", "pixel": 100, "quality": 80}, {"name": "a", "pixel": 200, "quality": 80}]}`,
+		`{"default": "a", "sizes": [{"name": "", "pixel": 100, "quality": 80}]}`,
+		`{"default": "a", "sizes": [{"name": "a", "pixel": 0, "quality": 80}]}`,
+		`{"default": "a", "sizes": [{"name": "a", "pixel": 100, "quality": 0}]}`,
+		`{"default": "a", "sizes": [{"name": "a", "pixel": 100, "quality": 101}]}`,
+		`{"default": "a", "sizes": [{"name": "a", "pixel": 100, "quality": 80, "chroma_subsampling": "4:1:1"}]}`,
+		`{"default": "a", "sizes": [{"name": "a", "pixel": 100, "quality": 80, "sharpen": -1}]}`,
+		`{"default": "b", "sizes": [{"name": "a", "pixel": 100, "quality": 80}]}`,
+		`{"default": "a", "sizes": []}`,
+		`not json`,
+	} {
+		_, err := NewThumbSizes([]byte(data))
+		c.Assert(err, NotNil, Commentf("%s", data))
+	}
+}
+
+func (s *ThumbSizeSuite) TestAtLeast(c *C) {
+	// Unsorted on purpose.
+	sizes := &ThumbSizes{Sizes: []ThumbSize{{Name: "800", Pixel: 800}, {Name: "100", Pixel: 100}, {Name: "240", Pixel: 240}}}
+
+	c.Assert(sizes.AtLeast(0).Name, Equals, "100")
+	c.Assert(sizes.AtLeast(100).Name, Equals, "100")
+	c.Assert(sizes.AtLeast(101).Name, Equals, "240")
+	c.Assert(sizes.AtLeast(240).Name, Equals, "240")
+	c.Assert(sizes.AtLeast(241).Name, Equals, "800")
+	c.Assert(sizes.AtLeast(800).Name, Equals, "800")
+	c.Assert(sizes.AtLeast(5000).Name, Equals, "800") // Largest if none is large enough
+
+	c.Assert((&ThumbSizes{}).AtLeast(100), Equals, ThumbSize{})
+}
+
+func (s *ThumbSizeSuite) TestGet(c *C) {
+	size, err := DefaultThumbSizes.Get("")
+	c.Assert(err, IsNil)
+	c.Assert(size.Name, Equals, DefaultThumbSizes.Default)
+
+	_, err = DefaultThumbSizes.Get("9999")
+	c.Assert(err, NotNil)
+}
@@ -1,18 +1,25 @@
 package backend
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
 
 	"github.com/fxkr/openview/backend/cache"
 	"github.com/fxkr/openview/backend/image"
 	"github.com/fxkr/openview/backend/model"
+	"github.com/fxkr/openview/backend/util"
 	"github.com/fxkr/openview/backend/util/handler"
 	"github.com/fxkr/openview/backend/util/safe"
 )
@@ -21,24 +28,49 @@ type Service interface {
 	Get(path safe.RelativePath) http.Handler
 	GetDirectory(path safe.RelativePath, page model.Page) http.Handler
 	GetImage(path safe.RelativePath) http.Handler
-	GetImageThumbnail(path safe.RelativePath, size model.ThumbSize) http.Handler
+	GetImageThumbnail(path safe.RelativePath, size model.ThumbSize, poster bool) http.Handler
+	GetImageProtected(path safe.RelativePath) http.Handler
+	GetContactSheet(path safe.RelativePath, layout model.ContactSheet) http.Handler
+	GetDeepZoomDescriptor(path safe.RelativePath) http.Handler
+	GetDeepZoomTile(path safe.RelativePath, level uint, col uint, row uint) http.Handler
+	CollectGarbage(dryRun bool, fn func(GCEntry)) (*GCReport, error)
+	ExportCache(w io.Writer, exclude []string) (*ArchiveReport, error)
+	ImportCache(r io.Reader, exclude []string) (*ArchiveReport, error)
 }
 
-func NewService(base safe.Path, res safe.Path, thumbnailCache cache.Cache, metadataCache cache.Cache) Service {
-	return &service{base, res, thumbnailCache, metadataCache}
+func NewService(config *Config, thumbnailCache cache.Cache, metadataCache cache.Cache) Service {
+	return &service{
+		base:           config.ImageDir,
+		res:            config.ResourceDir,
+		config:         config,
+		thumbnailCache: thumbnailCache,
+		metadataCache:  metadataCache,
+	}
 }
 
 type service struct {
 	base           safe.Path
 	res            safe.Path
+	config         *Config
 	thumbnailCache cache.Cache
 	metadataCache  cache.Cache
+
+	// deepZoomLocks are keyed by Deep Zoom batch and block,
+	// so concurrent tile requests don't decode the same huge image many times.
+	deepZoomLocks util.KeyedMutex
+
+	// settingsFiles maps paths of settings files to *parsedSettingsFile.
+	settingsFiles sync.Map
 }
 
 // Statically assert that *service implements Service.
 var _ Service = (*service)(nil)
 
 func (s *service) Get(path safe.RelativePath) http.Handler {
+	if isHidden(path) {
+		return handler.Status(http.StatusNotFound)
+	}
+
 	fullPath := s.base.Join(path)
 
 	fileInfo, err := os.Stat(fullPath.String())
@@ -51,10 +83,34 @@ func (s *service) Get(path safe.RelativePath) http.Handler {
 		return &handler.FileHandler{Path: fullPath}
 	}
 
-	return &handler.FileHandler{Path: fullPath}
+	settings, err := s.getSettings(path.Dir())
+	if err != nil {
+		return handler.Error(err)
+	}
+
+	// In display size mode, originals never leave the server.
+	if settings.DisplaySize != 0 {
+		if !isImage(fileInfo) {
+			return handler.Status(http.StatusForbidden)
+		}
+
+		size := settings.displaySize()
+		cacheKey := safe.NewKey("display", path.String())
+		return s.getRendition(cacheKey, path, fileInfo, size, settings.Thumbnail.ForSize(size), false)
+	}
+
+	// Not getImageVersion, which would hash any file with content hash versioning.
+	return &handler.FileHandler{Path: fullPath, Validators: handler.Validators{
+		ETag:    handler.ETag(fileVersion(fileInfo).String()),
+		ModTime: fileInfo.ModTime(),
+	}}
 }
 
 func (s *service) GetDirectory(path safe.RelativePath, page model.Page) http.Handler {
+	if isHidden(path) {
+		return handler.Status(http.StatusNotFound)
+	}
+
 	fullPath := s.base.Join(path)
 
 	var pt model.PageToken
@@ -78,7 +134,7 @@ func (s *service) GetDirectory(path safe.RelativePath, page model.Page) http.Han
 
 	var nextPageToken *model.PageToken
 	directories := make([]model.Directory, 0)
-	images := make([]model.Image, 0)
+	imagePaths := make([]safe.RelativePath, 0)
 	for _, fileInfo := range fileInfos[start:] {
 		relativePath := path.Join(safe.UnsafeNewRelativePath(fileInfo.Name()))
 
@@ -99,23 +155,20 @@ func (s *service) GetDirectory(path safe.RelativePath, page model.Page) http.Han
 			}
 
 		} else if isImage(fileInfo) {
-			image, err := s.getImageData(relativePath)
-			if err != nil {
-				return handler.Error(err)
-			}
-
-			images = append(images, *image)
+			imagePaths = append(imagePaths, relativePath)
 			nextPageToken = &model.PageToken{
 				Name:      relativePath.String(),
 				Directory: false,
 			}
 		}
 
-		if len(directories)+len(images) >= page.PageSize {
+		if len(directories)+len(imagePaths) >= page.PageSize {
 			break
 		}
 	}
 
+	images := s.getImagesData(imagePaths)
+
 	return &handler.JSONHandler{Data: GetDirectoryResponse{
 		Directory: model.Directory{
 			Item: model.Item{
@@ -132,6 +185,10 @@ func (s *service) GetDirectory(path safe.RelativePath, page model.Page) http.Han
 }
 
 func (s *service) GetImage(path safe.RelativePath) http.Handler {
+	if isHidden(path) {
+		return handler.Status(http.StatusNotFound)
+	}
+
 	img, err := s.getImageData(path)
 	if err != nil {
 		return handler.Error(err)
@@ -139,7 +196,14 @@ func (s *service) GetImage(path safe.RelativePath) http.Handler {
 	return &handler.JSONHandler{Data: &GetImageResponse{*img}}
 }
 
-func (s *service) GetImageThumbnail(path safe.RelativePath, size model.ThumbSize) http.Handler {
+// GetImageThumbnail returns a thumbnail of an image.
+//
+// Animations get animated thumbnails within the configured limits, unless a (still) poster is requested.
+func (s *service) GetImageThumbnail(path safe.RelativePath, size model.ThumbSize, poster bool) http.Handler {
+	if isHidden(path) {
+		return handler.Status(http.StatusNotFound)
+	}
+
 	fullPath := s.base.Join(path)
 
 	cacheKey := safe.NewKey("thumbnail", path.String(), size.Name)
@@ -152,15 +216,139 @@ func (s *service) GetImageThumbnail(path safe.RelativePath, size model.ThumbSize
 		return handler.Status(http.StatusNotFound)
 	}
 
-	cacheVersion := s.getImageVersion(fileInfo)
+	settings, err := s.getSettings(path.Dir())
+	if err != nil {
+		return handler.Error(err)
+	}
+	size = settings.thumbSize(size)
+
+	if !poster && isAnimatable(fileInfo) {
+		img, err := s.getImageData(path)
+		if err != nil && !isBroken(err) {
+			return handler.Error(err)
+		}
+
+		// Broken animations get the still rendition, which is the placeholder.
+		if err == nil && s.config.Animation.Animate(img, size) {
+			cacheKey := safe.NewKey("animated", path.String(), size.Name)
+			return s.getRendition(cacheKey, path, fileInfo, size, settings.Thumbnail.ForSize(size), true)
+		}
+	}
+
+	return s.getRendition(cacheKey, path, fileInfo, size, settings.Thumbnail.ForSize(size), false)
+}
+
+func (s *service) GetImageProtected(path safe.RelativePath) http.Handler {
+	if isHidden(path) {
+		return handler.Status(http.StatusNotFound)
+	}
+
+	fullPath := s.base.Join(path)
+
+	cacheKey := safe.NewKey("protected", path.String())
+
+	fileInfo, err := os.Stat(fullPath.String())
+	if err != nil {
+		return handler.StatusError(http.StatusNotFound, err)
+	}
+	if !isImage(fileInfo) {
+		return handler.Status(http.StatusNotFound)
+	}
+
+	settings, err := s.getSettings(path.Dir())
+	if err != nil {
+		return handler.Error(err)
+	}
+	return s.getRendition(cacheKey, path, fileInfo, settings.protectedSize(), settings.Thumbnail, false)
+}
+
+// getRendition returns a handler serving a (cached) rendition of an image.
+func (s *service) getRendition(cacheKey cache.Key, path safe.RelativePath, fileInfo os.FileInfo, size model.ThumbSize, options image.ThumbnailOptions, animated bool) http.Handler {
+	fullPath := s.base.Join(path)
+	cacheVersion := s.getThumbnailVersion(path, fileInfo, size, options)
+
+	contentType := ThumbnailContentType
+	if animated {
+		contentType = image.AnimatedContentType(fullPath)
+	}
+
+	h, err := s.thumbnailCache.GetStreamHandler(cacheKey, cacheVersion, s.renderer(path, fileInfo, size, options, cacheVersion, animated), contentType)
+	if isBroken(err) {
+		return s.placeholder()
+	} else if err != nil {
+		return handler.Error(err)
+	}
+
+	return h
+}
+
+// renderer returns a cache filler that renders an image.
+//
+// Renditions are written to the cache as they're encoded, so with a file cache they're never held in memory.
+func (s *service) renderer(path safe.RelativePath, fileInfo os.FileInfo, size model.ThumbSize, options image.ThumbnailOptions, cacheVersion cache.Version, animated bool) cache.StreamFiller {
+	render := image.RenderThumbnail
+	if animated {
+		render = image.RenderAnimatedThumbnail
+	}
+
+	return func(w io.Writer) (cache.Version, error) {
+		err := s.decode(path, fileInfo, func() error {
+			return render(w, s.base.Join(path), size, options)
+		})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		return cacheVersion, nil
+	}
+}
 
-	h, err := s.thumbnailCache.GetHandler(cacheKey, cacheVersion, func() (cache.Version, []byte, error) {
-		bytes, err := image.RenderThumbnail(fullPath, size)
+// buffered adapts a streaming filler to GetBytes, for values that are needed in memory anyway.
+func buffered(filler cache.StreamFiller) func() (cache.Version, []byte, error) {
+	return func() (cache.Version, []byte, error) {
+		var buffer bytes.Buffer
+		version, err := filler(&buffer)
 		if err != nil {
 			return nil, nil, errors.WithStack(err)
 		}
 
-		return cacheVersion, bytes, nil
+		return version, buffer.Bytes(), nil
+	}
+}
+
+// GetContactSheet returns a grid of the thumbnails of the images in a directory.
+func (s *service) GetContactSheet(path safe.RelativePath, layout model.ContactSheet) http.Handler {
+	if isHidden(path) {
+		return handler.Status(http.StatusNotFound)
+	}
+
+	sheet, err := s.getContactSheet(path, layout)
+	if err != nil {
+		return handler.Error(err)
+	}
+
+	h, err := s.thumbnailCache.GetStreamHandler(sheet.cacheKey, sheet.cacheVersion, func(w io.Writer) (cache.Version, error) {
+		sheetTiles := make([]image.ContactSheetTile, 0, len(sheet.tiles))
+		for _, t := range sheet.tiles {
+			thumbnail, err := s.thumbnailCache.GetBytes(t.cacheKey, t.cacheVersion, buffered(s.renderer(t.path, t.fileInfo, sheet.size, sheet.options, t.cacheVersion, false)))
+			if isBroken(err) {
+				continue
+			} else if err != nil {
+				return nil, errors.WithStack(err)
+			}
+
+			sheetTiles = append(sheetTiles, image.ContactSheetTile{
+				Thumbnail: thumbnail,
+				Caption:   t.name,
+			})
+		}
+
+		err := image.RenderContactSheet(w, sheetTiles, layout)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		return sheet.cacheVersion, nil
 	}, ThumbnailContentType)
 
 	if err != nil {
@@ -170,6 +358,201 @@ func (s *service) GetImageThumbnail(path safe.RelativePath, size model.ThumbSize
 	return h
 }
 
+// contactSheet is what a contact sheet is rendered from.
+type contactSheet struct {
+	size         model.ThumbSize
+	options      image.ThumbnailOptions
+	tiles        []contactSheetTile
+	cacheKey     cache.Key
+	cacheVersion cache.Version
+}
+
+type contactSheetTile struct {
+	name         string
+	path         safe.RelativePath
+	fileInfo     os.FileInfo
+	cacheKey     cache.Key
+	cacheVersion cache.Version
+}
+
+// getContactSheet lists the thumbnails that go on the contact sheet of a directory.
+func (s *service) getContactSheet(path safe.RelativePath, layout model.ContactSheet) (*contactSheet, error) {
+	fileInfos, err := ioutil.ReadDir(s.base.Join(path).String())
+	if err != nil {
+		return nil, handler.StatusError(http.StatusNotFound, errors.WithStack(err))
+	}
+
+	sort.Slice(fileInfos, func(a, b int) bool {
+		return model.FileInfoLessThan(fileInfos[a], fileInfos[b])
+	})
+
+	settings, err := s.getSettings(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// Tiles are made from the smallest thumbnails that are large enough, so they are likely cached already.
+	size := settings.thumbSize(s.config.ThumbSizes.AtLeast(layout.TileSize))
+	options := settings.Thumbnail.ForSize(size)
+
+	// The contact sheet's version covers the versions of all thumbnails on it.
+	// It's hashed since it can get too large for a cache version.
+	hash := sha256.New()
+	enc := json.NewEncoder(hash)
+	enc.Encode(layout)
+
+	tiles := make([]contactSheetTile, 0)
+	for _, fileInfo := range fileInfos {
+		if !isImage(fileInfo) {
+			continue
+		}
+		if len(tiles) >= model.MaxContactSheetItems {
+			break
+		}
+
+		relativePath := path.Join(safe.UnsafeNewRelativePath(fileInfo.Name()))
+		cacheVersion := s.getThumbnailVersion(relativePath, fileInfo, size, options)
+		enc.Encode([]string{fileInfo.Name(), cacheVersion.String()})
+
+		tiles = append(tiles, contactSheetTile{
+			name:         fileInfo.Name(),
+			path:         relativePath,
+			fileInfo:     fileInfo,
+			cacheKey:     safe.NewKey("thumbnail", relativePath.String(), size.Name),
+			cacheVersion: cacheVersion,
+		})
+	}
+
+	return &contactSheet{
+		size:         size,
+		options:      options,
+		tiles:        tiles,
+		cacheKey:     safe.NewKey("contact-sheet", path.String(), layout.Columns, layout.TileSize),
+		cacheVersion: safe.NewKey(hex.EncodeToString(hash.Sum(nil))),
+	}, nil
+}
+
+// GetDeepZoomDescriptor returns the DZI descriptor of an image.
+func (s *service) GetDeepZoomDescriptor(path safe.RelativePath) http.Handler {
+	if isHidden(path) {
+		return handler.Status(http.StatusNotFound)
+	}
+
+	dz, err := s.getDeepZoom(path)
+	if err != nil {
+		return handler.Error(err)
+	}
+
+	return &handler.XMLHandler{Data: dz.Descriptor()}
+}
+
+// GetDeepZoomTile returns a tile of the Deep Zoom pyramid of an image.
+//
+// Tiles are rendered a block (or batch of small levels) at a time, since that needs the image decoded anyway.
+func (s *service) GetDeepZoomTile(path safe.RelativePath, level uint, col uint, row uint) http.Handler {
+	if isHidden(path) {
+		return handler.Status(http.StatusNotFound)
+	}
+
+	fullPath := s.base.Join(path)
+
+	fileInfo, err := os.Stat(fullPath.String())
+	if err != nil {
+		return handler.StatusError(http.StatusNotFound, err)
+	}
+
+	dz, err := s.getDeepZoom(path)
+	if err != nil {
+		return handler.Error(err)
+	}
+	if !dz.HasTile(level, col, row) {
+		return handler.Status(http.StatusNotFound)
+	}
+
+	cacheVersion, options, err := s.getDeepZoomVersion(path, fileInfo, dz)
+	if err != nil {
+		return handler.Error(err)
+	}
+
+	tileKey := func(level uint, col uint, row uint) cache.Key {
+		return safe.NewKey("dzi-tile", path.String(), dz.TileSize, level, col, row)
+	}
+
+	firstCol, firstRow, _, _ := dz.Block(level, col, row)
+	unlock := s.deepZoomLocks.Lock(safe.NewKey(path.String(), dz.Batch(level)[0], firstCol, firstRow).String())
+	defer unlock()
+
+	h, err := s.thumbnailCache.GetStreamHandler(tileKey(level, col, row), cacheVersion, func(w io.Writer) (cache.Version, error) {
+		var result []byte
+		err := s.decode(path, fileInfo, func() error {
+			return image.RenderDeepZoomBatch(fullPath, dz, level, col, row, options, func(l uint, c uint, r uint, tile []byte) error {
+				if l == level && c == col && r == row {
+					result = tile
+					return nil
+				}
+
+				// Streamed puts skip the memory tier, so siblings that may never be requested don't evict hot thumbnails.
+				return s.thumbnailCache.PutStream(tileKey(l, c, r), cacheVersion, bytes.NewReader(tile), 0)
+			})
+		})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		_, err = w.Write(result)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return cacheVersion, nil
+	}, ThumbnailContentType)
+
+	if err != nil {
+		return handler.Error(err)
+	}
+
+	return h
+}
+
+// getDeepZoom returns the Deep Zoom pyramid layout of an image.
+//
+// In display size mode, the pyramid stops at the display size.
+func (s *service) getDeepZoom(path safe.RelativePath) (model.DeepZoom, error) {
+	img, err := s.getImageData(path)
+	if err != nil {
+		return model.DeepZoom{}, errors.WithStack(err)
+	}
+
+	settings, err := s.getSettings(path.Dir())
+	if err != nil {
+		return model.DeepZoom{}, errors.WithStack(err)
+	}
+
+	width, height := model.ThumbSize{Pixel: settings.DisplaySize}.Fit(img.Width, img.Height)
+	return model.NewDeepZoom(width, height), nil
+}
+
+// getDeepZoomVersion returns the cache version of the tiles of an image's Deep Zoom pyramid,
+// and the options they are rendered with.
+func (s *service) getDeepZoomVersion(path safe.RelativePath, fileInfo os.FileInfo, dz model.DeepZoom) (cache.Version, image.ThumbnailOptions, error) {
+	settings, err := s.getSettings(path.Dir())
+	if err != nil {
+		return nil, image.ThumbnailOptions{}, errors.WithStack(err)
+	}
+	options := settings.Thumbnail
+
+	return safe.NewKey(s.getThumbnailVersion(path, fileInfo, image.DeepZoomSize, options).String(), dz), options, nil
+}
+
+// isHidden returns true if a path has a component starting with a dot, like settings files and watermarks.
+func isHidden(path safe.RelativePath) bool {
+	for _, component := range path.Components() {
+		if strings.HasPrefix(component.String(), ".") {
+			return true
+		}
+	}
+	return false
+}
+
 func isImageDirectory(fileInfo os.FileInfo) bool {
 	if !fileInfo.Mode().IsDir() {
 		return false
@@ -194,9 +577,15 @@ func isImage(fileInfo os.FileInfo) bool {
 	ext := filepath.Ext(fileInfo.Name())
 	ext = strings.ToLower(ext)
 
-	if ext != ".jpg" && ext != ".jpeg" && ext != ".png" {
+	if ext != ".jpg" && ext != ".jpeg" && ext != ".png" && ext != ".gif" && ext != ".webp" {
 		return false
 	}
 
 	return true
 }
+
+// isAnimatable returns true for images in formats that support animation.
+func isAnimatable(fileInfo os.FileInfo) bool {
+	ext := strings.ToLower(filepath.Ext(fileInfo.Name()))
+	return ext == ".gif" || ext == ".webp"
+}
@@ -0,0 +1,196 @@
+package backend
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/fxkr/openview/backend/image"
+	"github.com/fxkr/openview/backend/model"
+	"github.com/fxkr/openview/backend/util/safe"
+)
+
+// SettingsFileName is the name of per-directory settings files.
+//
+// Like all dot files, settings files are hidden from listings.
+const SettingsFileName = ".openview.json"
+
+// Settings are the effective settings for a directory.
+//
+// They start out as the global Config and are overridden by the settings files
+// of the directory and all its parents, outermost first.
+type Settings struct {
+	Thumbnail image.ThumbnailOptions
+
+	// DisplaySize is the maximum size (in pixels) images are served in. Zero means originals are served.
+	DisplaySize uint
+}
+
+// settingsFile is the format of a settings file.
+//
+// Absent fields are inherited from the parent directory.
+type settingsFile struct {
+	Watermark   *watermarkSettings `json:"watermark"`
+	DisplaySize *uint              `json:"display_size"`
+}
+
+// watermarkSettings overrides an inherited image.Watermark.
+//
+// Setting Image or Text replaces both, so an empty Text disables the watermark.
+// Image is relative to the directory containing the settings file. To keep it out of listings,
+// its name should start with a dot.
+type watermarkSettings struct {
+	Image    *string  `json:"image"`
+	Text     *string  `json:"text"`
+	Position *string  `json:"position"`
+	Opacity  *float64 `json:"opacity"`
+	Scale    *float64 `json:"scale"`
+	MinSize  *uint    `json:"min_size"`
+}
+
+// getSettings returns the settings for a directory.
+func (s *service) getSettings(dir safe.RelativePath) (*Settings, error) {
+	result := &Settings{
+		Thumbnail:   s.config.Thumbnail,
+		DisplaySize: s.config.DisplaySize,
+	}
+
+	current := safe.RelativePath{}
+	err := s.loadSettings(result, s.base.Join(current))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	for _, component := range dir.Components() {
+		current = current.Join(component)
+		err := s.loadSettings(result, s.base.Join(current))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	return result, nil
+}
+
+// parsedSettingsFile is a settingsFile as of the modification time and size of the file it was parsed from.
+type parsedSettingsFile struct {
+	modTime time.Time
+	size    int64
+	file    *settingsFile
+}
+
+// loadSettings applies the settings file in a directory to settings, if there is one.
+//
+// Parsed settings files are kept until they change, so only one stat per directory is needed.
+func (s *service) loadSettings(settings *Settings, dir safe.Path) error {
+	path := dir.JoinUnsafe(SettingsFileName).String()
+
+	stat, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		s.settingsFiles.Delete(path)
+		return nil
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if value, ok := s.settingsFiles.Load(path); ok {
+		cached := value.(*parsedSettingsFile)
+		if cached.modTime.Equal(stat.ModTime()) && cached.size == stat.Size() {
+			return errors.WithStack(settings.apply(dir, cached.file))
+		}
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	file := &settingsFile{}
+	err = json.Unmarshal(buf, file)
+	if err != nil {
+		return errors.Wrapf(err, "Bad settings file in %v", dir.String())
+	}
+	s.settingsFiles.Store(path, &parsedSettingsFile{stat.ModTime(), stat.Size(), file})
+
+	return errors.WithStack(settings.apply(dir, file))
+}
+
+// thumbSize returns a thumbnail size limited to the display size.
+func (settings *Settings) thumbSize(size model.ThumbSize) model.ThumbSize {
+	if settings.DisplaySize != 0 && size.Pixel > settings.DisplaySize {
+		size.Pixel = settings.DisplaySize
+	}
+	return size
+}
+
+// displaySize returns the size of the renditions served instead of originals in display size mode.
+func (settings *Settings) displaySize() model.ThumbSize {
+	size := image.ProtectedSize
+	size.Name = "display"
+	size.Pixel = settings.DisplaySize
+	return size
+}
+
+// protectedSize returns the size of protected originals.
+func (settings *Settings) protectedSize() model.ThumbSize {
+	size := image.ProtectedSize
+	size.Pixel = settings.DisplaySize
+	return size
+}
+
+// apply applies a settings file in dir.
+func (settings *Settings) apply(dir safe.Path, file *settingsFile) error {
+	if file.Watermark != nil {
+		watermark, err := file.Watermark.apply(dir, settings.Thumbnail.Watermark)
+		if err != nil {
+			return errors.Wrapf(err, "Bad settings file in %v", dir.String())
+		}
+		settings.Thumbnail.Watermark = watermark
+	}
+	if file.DisplaySize != nil {
+		settings.DisplaySize = *file.DisplaySize
+	}
+
+	return nil
+}
+
+func (ws *watermarkSettings) apply(dir safe.Path, w image.Watermark) (image.Watermark, error) {
+	if ws.Image != nil || ws.Text != nil {
+		w.Image = safe.Path{}
+		w.Text = ""
+	}
+	if ws.Image != nil && *ws.Image != "" {
+		relativePath, err := safe.NewRelativePath(*ws.Image)
+		if err != nil {
+			return image.Watermark{}, errors.WithStack(err)
+		}
+		w.Image = dir.Join(relativePath)
+	}
+	if ws.Text != nil {
+		w.Text = *ws.Text
+	}
+	if ws.Position != nil {
+		position, err := image.NewPosition(*ws.Position)
+		if err != nil {
+			return image.Watermark{}, errors.WithStack(err)
+		}
+		w.Position = position
+	}
+	if ws.Opacity != nil {
+		w.Opacity = *ws.Opacity
+	}
+	if ws.Scale != nil {
+		w.Scale = *ws.Scale
+	}
+	if ws.MinSize != nil {
+		w.MinSize = *ws.MinSize
+	}
+	err := w.Validate()
+	if err != nil {
+		return image.Watermark{}, errors.WithStack(err)
+	}
+	return w, nil
+}
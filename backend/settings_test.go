@@ -0,0 +1,89 @@
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+
+	"github.com/fxkr/openview/backend/cache"
+	"github.com/fxkr/openview/backend/util/safe"
+)
+
+func TestSettings(t *testing.T) {
+	_ = Suite(&SettingsSuite{})
+	TestingT(t)
+}
+
+type SettingsSuite struct {
+	tempDir safe.Path
+	service *service
+}
+
+func (s *SettingsSuite) SetUpTest(c *C) {
+	tempDir, err := ioutil.TempDir("", "openview-test")
+	if err != nil {
+		c.Fatalf("Error: %+v", errors.WithStack(err))
+	}
+	s.tempDir = safe.UnsafeNewPath(tempDir)
+
+	c.Assert(os.Mkdir(s.tempDir.JoinUnsafe("sub").String(), 0700), IsNil)
+
+	s.service = NewService(&Config{ImageDir: s.tempDir, DisplaySize: 2000},
+		cache.NewMemoryCache(cache.MemoryCacheConfig{}), cache.NewMemoryCache(cache.MemoryCacheConfig{})).(*service)
+}
+
+func (s *SettingsSuite) TearDownTest(c *C) {
+	os.RemoveAll(s.tempDir.String())
+}
+
+func (s *SettingsSuite) writeSettings(c *C, dir string, content string) {
+	err := ioutil.WriteFile(s.tempDir.JoinUnsafe(dir).JoinUnsafe(SettingsFileName).String(), []byte(content), 0600)
+	c.Assert(err, IsNil)
+}
+
+func (s *SettingsSuite) TestGetSettings(c *C) {
+	sub := safe.UnsafeNewRelativePath("sub")
+
+	settings, err := s.service.getSettings(sub)
+	c.Assert(err, IsNil)
+	c.Assert(settings.DisplaySize, Equals, uint(2000))
+
+	s.writeSettings(c, ".", `{"display_size": 1000}`)
+	settings, err = s.service.getSettings(sub)
+	c.Assert(err, IsNil)
+	c.Assert(settings.DisplaySize, Equals, uint(1000))
+
+	// Innermost wins.
+	s.writeSettings(c, "sub", `{"display_size": 500}`)
+	settings, err = s.service.getSettings(sub)
+	c.Assert(err, IsNil)
+	c.Assert(settings.DisplaySize, Equals, uint(500))
+
+	// Changed files are parsed again.
+	s.writeSettings(c, "sub", `{"display_size": 5000}`)
+	settings, err = s.service.getSettings(sub)
+	c.Assert(err, IsNil)
+	c.Assert(settings.DisplaySize, Equals, uint(5000))
+
+	c.Assert(os.Remove(s.tempDir.JoinUnsafe("sub").JoinUnsafe(SettingsFileName).String()), IsNil)
+	settings, err = s.service.getSettings(sub)
+	c.Assert(err, IsNil)
+	c.Assert(settings.DisplaySize, Equals, uint(1000))
+}
+
+func (s *SettingsSuite) TestWatermarkRange(c *C) {
+	s.writeSettings(c, ".", `{"watermark": {"opacity": 1.5}}`)
+	_, err := s.service.getSettings(safe.UnsafeNewRelativePath("sub"))
+	c.Assert(err, NotNil)
+
+	s.writeSettings(c, ".", `{"watermark": {"scale": -0.1}}`)
+	_, err = s.service.getSettings(safe.UnsafeNewRelativePath("sub"))
+	c.Assert(err, NotNil)
+
+	s.writeSettings(c, ".", `{"watermark": {"opacity": 1, "scale": 0}}`)
+	_, err = s.service.getSettings(safe.UnsafeNewRelativePath("sub"))
+	c.Assert(err, IsNil)
+}
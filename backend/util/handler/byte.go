@@ -1,20 +1,24 @@
 package handler
 
 import (
-	"bufio"
+	"bytes"
 	"net/http"
 )
 
+// ByteHandler serves content from memory with http.ServeContent, which adds support for range and HEAD requests.
 type ByteHandler struct {
 	Bytes       []byte
 	ContentType string
+	Validators
 }
 
 // Statically assert that *ByteHandler implements http.Handler.
 var _ http.Handler = (*ByteHandler)(nil)
 
 func (h *ByteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", h.ContentType)
-	w.WriteHeader(http.StatusOK)
-	bufio.NewWriter(w).Write(h.Bytes)
+	if h.ContentType != "" {
+		w.Header().Set("Content-Type", h.ContentType)
+	}
+	h.set(w.Header())
+	http.ServeContent(w, r, "", h.ModTime, bytes.NewReader(h.Bytes))
 }
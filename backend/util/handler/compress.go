@@ -0,0 +1,180 @@
+package handler
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Encodings are the content codings supported by Compress, most preferred first.
+var Encodings = []string{"br", "gzip"}
+
+// minCompressSize is the size below which compressing isn't worth it, if the size is known in advance.
+const minCompressSize = 256
+
+// compressibleTypes are media types worth compressing. Images other than SVG are compressed already.
+var compressibleTypes = map[string]bool{
+	"application/javascript": true,
+	"application/json":       true,
+	"application/xml":        true,
+	"image/svg+xml":          true,
+}
+
+// AcceptedEncoding returns the encoding out of encodings that the client prefers, or "" if it accepts none.
+//
+// Ties are broken by the order of encodings.
+func AcceptedEncoding(r *http.Request, encodings ...string) string {
+	qualities := map[string]float64{}
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					quality = q
+				}
+			}
+		}
+		qualities[name] = quality
+	}
+
+	best, bestQuality := "", 0.0
+	for _, encoding := range encodings {
+		quality, ok := qualities[encoding]
+		if !ok {
+			quality = qualities["*"]
+		}
+		if quality > bestQuality {
+			best, bestQuality = encoding, quality
+		}
+	}
+	return best
+}
+
+// Compress is a middleware that compresses text, JSON and XML responses with the encoding the client prefers.
+//
+// Only complete 200 OK responses to GET and HEAD requests are compressed, so ranges and other methods work as
+// without it. HEAD responses get the headers of the compressed GET response, without a body. Entity tags of
+// compressed responses are made weak, since they're still valid for If-None-Match, but no longer identify
+// the exact bytes. 304 Not Modified responses to clients with such a weak tag repeat it.
+func Compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := AcceptedEncoding(r, Encodings...)
+		if encoding == "" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{
+			ResponseWriter: w,
+			encoding:       encoding,
+			head:           r.Method == http.MethodHead,
+			ifNoneMatch:    r.Header.Get("If-None-Match"),
+		}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter decides whether to compress when the response header is written.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	head        bool
+	ifNoneMatch string
+
+	wroteHeader bool
+	compress    bool
+	writer      io.WriteCloser // Nil if not compressing, or for HEAD requests
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+
+	header := cw.Header()
+	etag := header.Get("ETag")
+	if status == http.StatusNotModified && etag != "" && !strings.HasPrefix(etag, "W/") && hasWeak(cw.ifNoneMatch, etag) {
+		header.Set("ETag", "W/"+etag)
+	} else if status == http.StatusOK && header.Get("Content-Encoding") == "" && compressible(header) {
+		cw.compress = true
+		header.Set("Content-Encoding", cw.encoding)
+		header.Del("Content-Length")
+		if etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+
+		if !cw.head {
+			if cw.encoding == "br" {
+				cw.writer = brotli.NewWriter(cw.ResponseWriter)
+			} else {
+				cw.writer, _ = gzip.NewWriterLevel(cw.ResponseWriter, gzip.DefaultCompression)
+			}
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		// Like net/http, which would do it after this handler has decided not to compress.
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if cw.writer != nil {
+		return cw.writer.Write(p)
+	} else if cw.compress && cw.head {
+		// Discarded, so net/http doesn't set Content-Length to the uncompressed length.
+		return len(p), nil
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// Close flushes compressed responses.
+func (cw *compressWriter) Close() error {
+	if cw.writer != nil {
+		return cw.writer.Close()
+	}
+	return nil
+}
+
+// hasWeak returns true if the list of an If-None-Match header has the weak form of etag.
+//
+// Clients only have it from compressed responses, so their copy is compressed.
+func hasWeak(list string, etag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		if strings.TrimSpace(candidate) == "W/"+etag {
+			return true
+		}
+	}
+	return false
+}
+
+// compressible returns true if a response with header is worth compressing.
+func compressible(header http.Header) bool {
+	if length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && length < minCompressSize {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || compressibleTypes[mediaType]
+}
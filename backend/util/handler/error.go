@@ -61,6 +61,11 @@ func (e *ErrorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		"cause":  cause,
 	}).Error("Request failed")
 
+	// Errors must not be cached or revalidated like the content they replace.
+	for _, name := range []string{"Cache-Control", "ETag", "Last-Modified"} {
+		w.Header().Del(name)
+	}
+
 	// Show pretty-printed response for manual requests
 	if !strings.Contains(r.Header.Get("Accept"), "application/json") {
 		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
@@ -1,17 +1,44 @@
 package handler
 
 import (
-	"github.com/fxkr/openview/backend/util/safe"
 	"net/http"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/fxkr/openview/backend/util/safe"
 )
 
+// FileHandler serves a file.
+//
+// Without an ETag, the file's modification time is used as validator. Otherwise only the given Validators are.
 type FileHandler struct {
 	Path safe.Path
+	Validators
 }
 
 // Statically assert that *FileHandler implements http.Handler.
 var _ http.Handler = (*FileHandler)(nil)
 
 func (h *FileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	http.ServeFile(w, r, h.Path.String())
+	if h.ETag == "" {
+		http.ServeFile(w, r, h.Path.String())
+		return
+	}
+
+	f, err := os.Open(h.Path.String())
+	if err != nil {
+		StatusError(http.StatusNotFound, errors.WithStack(err)).ServeHTTP(w, r)
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		Error(errors.WithStack(err)).ServeHTTP(w, r)
+		return
+	}
+
+	h.set(w.Header())
+	http.ServeContent(w, r, stat.Name(), h.ModTime, f)
 }
@@ -1,10 +1,15 @@
 package handler
 
 import (
+	"bytes"
 	"encoding/json"
 	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
 )
 
+// JSONHandler serves data as JSON, with an entity tag derived from the encoded data.
 type JSONHandler struct {
 	Data interface{}
 }
@@ -13,7 +18,18 @@ type JSONHandler struct {
 var _ http.Handler = (*JSONHandler)(nil)
 
 func (h *JSONHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	err := json.NewEncoder(&buf).Encode(h.Data)
+	if err != nil {
+		Error(errors.WithStack(err)).ServeHTTP(w, r)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if (Validators{ETag: ETag(buf.String())}).notModified(w, r) {
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(h.Data)
+	w.Write(buf.Bytes())
 }
@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+)
+
+// ReaderHandler serves content from a reader, closing it afterwards if it's an io.Closer.
+//
+// Seekable readers are served with http.ServeContent, which adds support for range requests.
+// The behavior if called more than once is undefined.
+type ReaderHandler struct {
+	Reader      io.Reader
+	ContentType string
+	Validators
+}
+
+// Statically assert that *ReaderHandler implements http.Handler.
+var _ http.Handler = (*ReaderHandler)(nil)
+
+func (h *ReaderHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if closer, ok := h.Reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	if h.ContentType != "" {
+		w.Header().Set("Content-Type", h.ContentType)
+	}
+
+	if seeker, ok := h.Reader.(io.ReadSeeker); ok {
+		h.set(w.Header())
+		http.ServeContent(w, r, "", h.ModTime, seeker)
+		return
+	}
+
+	if h.notModified(w, r) {
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, h.Reader)
+}
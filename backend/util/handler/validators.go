@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Validators identify the content of a response, so clients can revalidate their copies with conditional requests.
+type Validators struct {
+	ETag    string    // Strong entity tag including the quotes, see ETag; empty if unknown
+	ModTime time.Time // When the content was last modified; zero if unknown
+}
+
+// ETag returns a strong entity tag for the content identified by version, e.g. a cache version.
+func ETag(version string) string {
+	sum := sha256.Sum256([]byte(version))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// set sets the ETag and Last-Modified headers, as far as they're known.
+func (v Validators) set(header http.Header) {
+	if v.ETag != "" {
+		header.Set("ETag", v.ETag)
+	}
+	if !v.ModTime.IsZero() {
+		header.Set("Last-Modified", v.ModTime.UTC().Format(http.TimeFormat))
+	}
+}
+
+// notModified sets the validator headers and answers conditional requests for current content with 304 Not Modified.
+//
+// It returns true if the request was answered. Like with http.ServeContent, If-None-Match takes precedence
+// over If-Modified-Since.
+func (v Validators) notModified(w http.ResponseWriter, r *http.Request) bool {
+	v.set(w.Header())
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if v.ETag == "" || !etagMatches(inm, v.ETag) {
+			return false
+		}
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && !v.ModTime.IsZero() {
+		t, err := http.ParseTime(ims)
+		if err != nil || v.ModTime.Truncate(time.Second).After(t) {
+			return false
+		}
+	} else {
+		return false
+	}
+
+	w.Header().Del("Content-Type")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches returns true if etag is in the list of an If-None-Match header, using weak comparison.
+func etagMatches(list string, etag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
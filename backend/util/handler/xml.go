@@ -0,0 +1,35 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// XMLHandler serves data as XML, with an entity tag derived from the encoded data.
+type XMLHandler struct {
+	Data interface{}
+}
+
+// Statically assert that *XMLHandler implements http.Handler.
+var _ http.Handler = (*XMLHandler)(nil)
+
+func (h *XMLHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	buf := bytes.NewBufferString(xml.Header)
+	err := xml.NewEncoder(buf).Encode(h.Data)
+	if err != nil {
+		Error(errors.WithStack(err)).ServeHTTP(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=UTF-8")
+	if (Validators{ETag: ETag(buf.String())}).notModified(w, r) {
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
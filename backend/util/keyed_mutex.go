@@ -0,0 +1,53 @@
+package util
+
+import (
+	"sync"
+)
+
+// KeyedMutex is a set of mutexes identified by keys. The zero value is ready to use.
+//
+// Mutexes only exist while they're locked or waited for, so it doesn't grow with the number of keys ever used.
+type KeyedMutex struct {
+	lock    sync.Mutex
+	mutexes map[string]*keyedMutexEntry
+}
+
+type keyedMutexEntry struct {
+	sync.Mutex
+	refs int // Holder and waiters
+}
+
+// Lock locks the mutex of key, and returns the function that unlocks it.
+func (m *KeyedMutex) Lock(key string) func() {
+	m.lock.Lock()
+	if m.mutexes == nil {
+		m.mutexes = make(map[string]*keyedMutexEntry)
+	}
+	entry, ok := m.mutexes[key]
+	if !ok {
+		entry = &keyedMutexEntry{}
+		m.mutexes[key] = entry
+	}
+	entry.refs++
+	m.lock.Unlock()
+
+	entry.Lock()
+
+	return func() {
+		m.lock.Lock()
+		entry.refs--
+		if entry.refs == 0 {
+			delete(m.mutexes, key)
+		}
+		m.lock.Unlock()
+
+		entry.Unlock()
+	}
+}
+
+// len returns the number of keys that are locked or waited for.
+func (m *KeyedMutex) len() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.mutexes)
+}
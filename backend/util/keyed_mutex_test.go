@@ -0,0 +1,45 @@
+package util
+
+import (
+	"sync"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestKeyedMutex(t *testing.T) {
+	_ = Suite(&KeyedMutexSuite{})
+	TestingT(t)
+}
+
+type KeyedMutexSuite struct {
+}
+
+func (s *KeyedMutexSuite) TestLock(c *C) {
+	var m KeyedMutex
+	var mapLock sync.Mutex // Only protects the map, the keyed mutex makes the increments atomic
+	counters := map[string]int{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		key := []string{"a", "b"}[i%2]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := m.Lock(key)
+			defer unlock()
+
+			mapLock.Lock()
+			counter := counters[key]
+			mapLock.Unlock()
+
+			mapLock.Lock()
+			counters[key] = counter + 1
+			mapLock.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	c.Assert(counters, DeepEquals, map[string]int{"a": 50, "b": 50})
+	c.Assert(m.len(), Equals, 0)
+}
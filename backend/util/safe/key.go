@@ -26,3 +26,20 @@ func NewKey(components ...interface{}) Key {
 func (k Key) String() string {
 	return string(k.raw)
 }
+
+// NewKeyPrefix constructs a prefix of the Strings of Keys whose first components are the given ones.
+//
+// If the last component is a string, it only has to be a prefix of the Keys' component, so
+// NewKeyPrefix("thumbnail", "album/") matches the thumbnails of all images under album/.
+// Otherwise, it has to match exactly, and the Keys must have more components.
+func NewKeyPrefix(components ...interface{}) string {
+	if len(components) == 0 {
+		return "["
+	}
+	prefix := NewKey(components...).String()
+	prefix = prefix[:len(prefix)-1] // Closing bracket
+	if _, ok := components[len(components)-1].(string); ok {
+		return prefix[:len(prefix)-1] // Closing quote
+	}
+	return prefix + ","
+}
@@ -1,6 +1,7 @@
 package safe
 
 import (
+	"strings"
 	"testing"
 
 	. "gopkg.in/check.v1"
@@ -18,3 +19,21 @@ func (s *KeySuite) TestNewPassword(c *C) {
 	k1 := NewKey("a", 0, []string{"c", "d"}, map[string]string{"e": "f"}, false)
 	c.Assert(k1.String(), Equals, "[\"a\",0,[\"c\",\"d\"],{\"e\":\"f\"},false]")
 }
+
+func (s *KeySuite) TestNewKeyPrefix(c *C) {
+	matches := func(key Key, prefix string) bool {
+		return strings.HasPrefix(key.String(), prefix)
+	}
+
+	prefix := NewKeyPrefix("thumbnail", "album/")
+	c.Assert(matches(NewKey("thumbnail", "album/a.jpg", "800"), prefix), Equals, true)
+	c.Assert(matches(NewKey("thumbnail", "album/sub/b.jpg", "800"), prefix), Equals, true)
+	c.Assert(matches(NewKey("thumbnail", "other/a.jpg", "800"), prefix), Equals, false)
+	c.Assert(matches(NewKey("display", "album/a.jpg"), prefix), Equals, false)
+
+	prefix = NewKeyPrefix("dzi-tile", "a.jpg", 256)
+	c.Assert(matches(NewKey("dzi-tile", "a.jpg", 256, 1, 2, 3), prefix), Equals, true)
+	c.Assert(matches(NewKey("dzi-tile", "a.jpg", 2560, 1, 2, 3), prefix), Equals, false)
+
+	c.Assert(matches(NewKey("a"), NewKeyPrefix()), Equals, true)
+}
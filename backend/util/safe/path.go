@@ -3,6 +3,7 @@ package safe
 import (
 	"encoding/json"
 	"path/filepath"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -113,6 +114,31 @@ func (p Path) JoinUnsafe(trustedString string) Path {
 	return Path{filepath.Join(p.raw, trustedString)}
 }
 
+// Dir returns all but the last component of the path.
+//
+// The Dir of a single component path is the empty path.
+func (p RelativePath) Dir() RelativePath {
+	dir := filepath.Dir(p.raw)
+	if dir == "." {
+		return RelativePath{}
+	}
+	return RelativePath{Path{dir}}
+}
+
+// Components returns the components of the path.
+//
+// An empty path has no components.
+func (p RelativePath) Components() []RelativePath {
+	if p.raw == "" {
+		return nil
+	}
+	var result []RelativePath
+	for _, component := range strings.Split(p.raw, "/") {
+		result = append(result, RelativePath{Path{component}})
+	}
+	return result
+}
+
 // Join concatenates two relative paths.
 func (p RelativePath) Join(extensionPath RelativePath) RelativePath {
 	return RelativePath{Path{filepath.Join(p.raw, extensionPath.raw)}}
@@ -294,3 +294,27 @@ func (s *PathSuite) TestEmptyPathBase(c *C) {
 	p := UnsafeNewRelativePath("")
 	c.Assert(p.Base(), Equals, "")
 }
+
+func (s *PathSuite) TestSubdirFilePathDir(c *C) {
+	p := UnsafeNewRelativePath("aa/bb/cc")
+	c.Assert(p.Dir().raw, Equals, "aa/bb")
+}
+
+func (s *PathSuite) TestFilePathDir(c *C) {
+	p := UnsafeNewRelativePath("aa")
+	c.Assert(p.Dir().IsEmpty(), Equals, true)
+}
+
+func (s *PathSuite) TestSubdirFilePathComponents(c *C) {
+	p := UnsafeNewRelativePath("aa/bb/cc")
+	c.Assert(p.Components(), DeepEquals, []RelativePath{
+		UnsafeNewRelativePath("aa"),
+		UnsafeNewRelativePath("bb"),
+		UnsafeNewRelativePath("cc"),
+	})
+}
+
+func (s *PathSuite) TestEmptyPathComponents(c *C) {
+	p := UnsafeNewRelativePath("")
+	c.Assert(p.Components(), HasLen, 0)
+}
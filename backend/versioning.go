@@ -0,0 +1,78 @@
+package backend
+
+import (
+	"encoding/hex"
+	"io"
+	"os"
+
+	"github.com/cespare/xxhash"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/fxkr/openview/backend/cache"
+	"github.com/fxkr/openview/backend/util/safe"
+)
+
+// Values of Config.ImageVersioning.
+const (
+	VersionModTime     = "mtime"
+	VersionContentHash = "hash"
+)
+
+// getImageVersion returns the version of an image, which the cache versions of everything derived from it cover.
+//
+// By default, it's the modification time and size. With content hash versioning, it's a hash of the content,
+// so touched or copied images aren't rendered again, and overwritten ones are even if their modification time was kept.
+func (s *service) getImageVersion(path safe.RelativePath, fileInfo os.FileInfo) cache.Version {
+	if s.config.ImageVersioning != VersionContentHash {
+		return fileVersion(fileInfo)
+	}
+
+	hash, err := s.getContentHash(path, fileInfo)
+	if err != nil {
+		log.WithError(err).WithField("path", path.String()).Warn("Failed to hash image, versioning it by modification time")
+		return fileVersion(fileInfo)
+	}
+	return safe.NewKey("xxhash", hash)
+}
+
+// fileVersion returns the version of a file by modification time and size.
+func fileVersion(fileInfo os.FileInfo) cache.Version {
+	return safe.NewKey(fileInfo.ModTime(), fileInfo.Size())
+}
+
+// getContentHash returns the hash of the content of an image.
+//
+// It's memoised in the metadata cache until the inode, change time, modification time or size of the file changes.
+// The change time catches files overwritten in place with their modification time restored.
+func (s *service) getContentHash(path safe.RelativePath, fileInfo os.FileInfo) (string, error) {
+	cacheKey := safe.NewKey("contenthash", path.String())
+	cacheVersion := getContentHashVersion(fileInfo)
+
+	hash, err := s.metadataCache.GetBytes(cacheKey, cacheVersion, func() (cache.Version, []byte, error) {
+		f, err := os.Open(s.base.Join(path).String())
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		defer f.Close()
+
+		h := xxhash.New()
+		_, err = io.Copy(h, f)
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+
+		return cacheVersion, []byte(hex.EncodeToString(h.Sum(nil))), nil
+	})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return string(hash), nil
+}
+
+// getContentHashVersion returns the cache version of the memoised content hash of a file.
+func getContentHashVersion(fileInfo os.FileInfo) cache.Version {
+	inode, changeTime := getInode(fileInfo)
+	return safe.NewKey(inode, changeTime, fileInfo.ModTime(), fileInfo.Size())
+}
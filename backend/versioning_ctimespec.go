@@ -0,0 +1,19 @@
+//go:build darwin || freebsd || netbsd
+// +build darwin freebsd netbsd
+
+package backend
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// getInode returns the inode number and change time of a file.
+func getInode(fileInfo os.FileInfo) (uint64, time.Time) {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, time.Time{}
+	}
+	return stat.Ino, time.Unix(stat.Ctimespec.Unix())
+}
@@ -0,0 +1,75 @@
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+
+	"github.com/fxkr/openview/backend/cache"
+	"github.com/fxkr/openview/backend/util/safe"
+)
+
+func TestVersioning(t *testing.T) {
+	_ = Suite(&VersioningSuite{})
+	TestingT(t)
+}
+
+type VersioningSuite struct {
+	tempDir  safe.Path
+	service  *service
+	metadata *cache.MemoryCache
+}
+
+func (s *VersioningSuite) SetUpTest(c *C) {
+	tempDir, err := ioutil.TempDir("", "openview-test")
+	if err != nil {
+		c.Fatalf("Error: %+v", errors.WithStack(err))
+	}
+	s.tempDir = safe.UnsafeNewPath(tempDir)
+
+	s.metadata = cache.NewMemoryCache(cache.MemoryCacheConfig{})
+	s.service = NewService(&Config{
+		ImageDir:        s.tempDir,
+		ImageVersioning: VersionContentHash,
+	}, cache.NewMemoryCache(cache.MemoryCacheConfig{}), s.metadata).(*service)
+}
+
+func (s *VersioningSuite) TearDownTest(c *C) {
+	os.RemoveAll(s.tempDir.String())
+}
+
+func (s *VersioningSuite) write(c *C, content string, modTime time.Time) (safe.RelativePath, os.FileInfo) {
+	fullPath := s.tempDir.JoinUnsafe("a.jpg").String()
+	c.Assert(ioutil.WriteFile(fullPath, []byte(content), 0600), IsNil)
+	c.Assert(os.Chtimes(fullPath, modTime, modTime), IsNil)
+
+	fileInfo, err := os.Stat(fullPath)
+	c.Assert(err, IsNil)
+	return safe.UnsafeNewRelativePath("a.jpg"), fileInfo
+}
+
+func (s *VersioningSuite) TestContentHash(c *C) {
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	version := s.service.getImageVersion(s.write(c, "jpeg", modTime))
+
+	// Overwritten in place, keeping the modification time and size.
+	// (The change time only advances with the kernel's clock tick.)
+	time.Sleep(50 * time.Millisecond)
+	overwritten := s.service.getImageVersion(s.write(c, "JPEG", modTime))
+	c.Assert(overwritten, Not(DeepEquals), version)
+
+	// Touched
+	c.Assert(s.service.getImageVersion(s.write(c, "JPEG", modTime.Add(time.Minute))), DeepEquals, overwritten)
+
+	var keys []string
+	c.Assert(s.metadata.Walk("", func(entry cache.Entry) error {
+		keys = append(keys, entry.Key.String())
+		return nil
+	}), IsNil)
+	c.Assert(keys, DeepEquals, []string{safe.NewKey("contenthash", "a.jpg").String()})
+}
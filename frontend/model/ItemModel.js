@@ -44,8 +44,10 @@ export default class ItemModel {
         name: imageData.name,
         relativePath: imageData.relative_path,
 
-        width: imageData.width,
-        height: imageData.height,
+        // Images the backend couldn't read have no dimensions. Show them as squares.
+        width: imageData.error ? 1 : imageData.width,
+        height: imageData.error ? 1 : imageData.height,
+        error: imageData.error === true,
 
         url: this.urlModel.getImageURL(imageData.relative_path),
 